@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"golang.org/x/net/html/charset"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxTextAttachment = 1 << 20 // characters of a text attachment sent to the model
+
+// blobTypes are the binary MIME types the model accepts as attachments
+var blobTypes = []string{
+	"application/pdf",
+	"image/png", "image/jpeg", "image/webp", "image/heic", "image/heif",
+	"audio/wav", "audio/wave", "audio/x-wav", "audio/mp3", "audio/mpeg", "audio/aiff", "audio/aac", "audio/ogg", "audio/flac",
+	"video/mp4", "video/mpeg", "video/quicktime", "video/mov", "video/avi", "video/x-flv", "video/mpg", "video/webm", "video/wmv", "video/3gpp",
+}
+
+// textTypes are MIME types which are text even though they don't start with text/
+var textTypes = []string{"application/json", "application/xml", "application/javascript", "application/x-sh", "application/sql", "application/x-yaml", "application/toml"}
+
+// baseMIMEType strips parameters like "; charset=utf-8"
+func baseMIMEType(mimeType string) string {
+	base, _, _ := strings.Cut(mimeType, ";")
+	return strings.ToLower(strings.TrimSpace(base))
+}
+
+// isTextFile reports whether a file should be sent as text. Files without a
+// known type are text if they decode to text.
+func isTextFile(mimeType string, data []byte) bool {
+	base := baseMIMEType(mimeType)
+	switch {
+	case strings.HasPrefix(base, "text/"), slices.Contains(textTypes, base):
+		return true
+	case slices.Contains(blobTypes, base):
+		return false
+	}
+	return hasTextBOM(data) || !isBinary(data)
+}
+
+// isBlobType reports whether the model accepts files of mimeType as data
+func isBlobType(mimeType string) bool {
+	return slices.Contains(blobTypes, baseMIMEType(mimeType))
+}
+
+func hasTextBOM(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}) || bytes.HasPrefix(data, []byte{0xFF, 0xFE}) || bytes.HasPrefix(data, []byte{0xFE, 0xFF})
+}
+
+// decodeText converts text in UTF-8, UTF-16 (with BOM) or a legacy charset
+// to UTF-8, the charset is detected from the content
+func decodeText(data []byte) (string, string) {
+	if !hasTextBOM(data) && utf8.Valid(data) {
+		return string(data), "utf-8"
+	}
+	encoding, name, _ := charset.DetermineEncoding(data, "")
+	if name == "utf-8" {
+		// only the start of the file was valid
+		encoding, name = charset.Lookup("windows-1252")
+	}
+	text, err := encoding.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "�"), "utf-8"
+	}
+	return strings.TrimPrefix(string(text), "\ufeff"), name
+}
+
+// textPart wraps the text of an attached file with its name
+func textPart(name string, text string) genai.Text {
+	note := ""
+	if len(text) > maxTextAttachment {
+		note = fmt.Sprintf("\n... (cut, %d more characters)", len(text)-maxTextAttachment)
+		text = strings.ToValidUTF8(text[:maxTextAttachment], "")
+	}
+	if !strings.HasSuffix(text, "\n") {
+		note += "\n"
+	}
+	return genai.Text(fmt.Sprintf("--- file: %s ---\n%s%s--- end of %s ---", name, text, note, name))
+}
+
+// documentText returns the text of office documents the model can't read
+// as data, ok is false for other files
+func documentText(path string) (text string, ok bool, err error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".docx", ".xlsx":
+		text, err := extractText(path)
+		return text, true, err
+	}
+	return "", false, nil
+}
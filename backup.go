@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const maxBackups = 100 // older backups are deleted
+
+// backupFile snapshots a file before a tool changes it, so the change can be
+// undone from Settings > Files. A file which did not exist is recorded with an
+// empty BackupPath, restoring that backup removes the file again.
+func backupFile(path string, old []byte, existed bool) error {
+	backup := FileBackup{Path: path}
+	if existed {
+		supportDir, err := getAppSupportDir()
+		if err != nil {
+			return err
+		}
+		backupDir := filepath.Join(supportDir, "backups")
+		if err := os.MkdirAll(backupDir, 0700); err != nil {
+			return err
+		}
+		backup.BackupPath = filepath.Join(backupDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(path)))
+		if err := os.WriteFile(backup.BackupPath, old, 0600); err != nil {
+			return err
+		}
+	}
+	if err := InsertBackup(db, &backup); err != nil {
+		return err
+	}
+	pruneBackups()
+	return nil
+}
+
+// restoreBackup puts a file back into the state of the backup. The current
+// state is backed up first, so a restore can be undone as well.
+func restoreBackup(backup FileBackup) error {
+	current, err := os.ReadFile(backup.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := backupFile(backup.Path, current, err == nil); err != nil {
+		return err
+	}
+
+	if backup.BackupPath == "" {
+		err := os.Remove(backup.Path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := os.ReadFile(backup.BackupPath)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(backup.Path, data)
+}
+
+func pruneBackups() {
+	old, err := ListBackups(db, maxBackups, -1)
+	if err != nil {
+		log.Println("Error listing backups:", err)
+		return
+	}
+	for _, backup := range old {
+		if backup.BackupPath != "" {
+			if err := os.Remove(backup.BackupPath); err != nil && !os.IsNotExist(err) {
+				log.Println("Error removing backup:", err)
+				continue
+			}
+		}
+		if err := DeleteBackup(db, backup.ID); err != nil {
+			log.Println("Error deleting backup:", err)
+		}
+	}
+}
+
+// writeFileAtomic writes a file through a temporary file in the same folder,
+// so an interrupted write never leaves half a file. A replaced file keeps
+// its permissions.
+func writeFileAtomic(path string, data []byte) error {
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// newApp opens the database and starts a chat on the provider selected in
+// settings. The returned app is nil if the database could not be opened, and
+// has no provider if neither the selected one nor Gemini could be started.
+func newApp() (*App, error) {
+	gormdb, err := InitDB()
+	if err != nil {
+		return nil, fmt.Errorf("error initializing database: %v", err)
+	}
+	db = gormdb
+
+	app := &App{}
+	app.apiKey = loadAPIKey()
+	cfg := loadProviderConfig(app.apiKey)
+	app.provider, err = NewProvider(context.Background(), cfg)
+	if err != nil && cfg.Kind != ProviderGemini {
+		// broken provider settings must not keep the app from starting, it
+		// runs on Gemini until they are fixed
+		log.Println("Error starting provider", cfg.Kind, "using Gemini:", err)
+		gemini, geminiErr := NewGeminiProvider(context.Background(), app.apiKey, GetSetting(db, ProviderGemini+"_model", ""))
+		if geminiErr != nil {
+			return app, err
+		}
+		app.provider = gemini
+		app.startChat()
+		return app, fmt.Errorf("error starting the %s provider, using Gemini instead: %v", cfg.Kind, err)
+	}
+	if err != nil {
+		return app, err
+	}
+	app.startChat()
+	return app, nil
+}
+
+// startChat starts a new chat session on the current provider, carrying over
+// the current conversation if there is one
+func (app *App) startChat() {
+	var conversation *Conversation
+	var history []*genai.Content
+	if app.cs != nil {
+		conversation = app.cs.conversation
+		// the provider or its key may have changed, with them the usable uploads
+		history = useUploads(app.cs.History(), uploadAccount(app.provider))
+	}
+
+	setEmbeddingProvider(app.provider)
+	app.sysprompt = getSysPrompt(context.Background(), "")
+	app.cs = newRecordingChat(app.provider.StartChat(ChatConfig{
+		SystemPrompt:    app.sysprompt,
+		Tools:           []*genai.Tool{toolRegistry.Declarations()},
+		MaxOutputTokens: 1000,
+		Temperature:     0.9,
+	}), conversation)
+	app.cs.SetHistory(history)
+	cs := app.cs
+	app.engine = NewChatEngine(cs, func(ctx context.Context, call genai.FunctionCall) (map[string]any, error) {
+		return toolRegistry.Call(cs.toolContext(ctx), call)
+	})
+	app.engine.MaxToolRounds = loadMaxToolRounds()
+}
+
+// refreshSystemPrompt gives the model the memory relevant to the message
+// about to be sent
+func (app *App) refreshSystemPrompt(ctx context.Context, message string) {
+	app.sysprompt = getSysPrompt(ctx, message)
+	app.cs.SetSystemPrompt(app.sysprompt)
+}
+
+// loadMaxToolRounds returns the max_tool_rounds setting
+func loadMaxToolRounds() int {
+	rounds, err := strconv.Atoi(GetSetting(db, "max_tool_rounds", ""))
+	if err != nil || rounds < 1 {
+		return DefaultMaxToolRounds
+	}
+	return rounds
+}
+
+// cancelMessage aborts the message in flight, if any
+func (app *App) cancelMessage() {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.cancel != nil {
+		app.cancel()
+	}
+}
+
+// stopMessage aborts the message in flight, if any, and waits until it has
+// ended, so nothing is added to the conversation afterwards
+func (app *App) stopMessage() {
+	app.mu.Lock()
+	cancel, ended := app.cancel, app.ended
+	app.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-ended
+	}
+}
+
+// beginMessage returns a context for a new message, ok is false if another one is in flight
+func (app *App) beginMessage() (ctx context.Context, ok bool) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.cancel != nil {
+		return nil, false
+	}
+	ctx, app.cancel = context.WithCancel(context.Background())
+	app.ended = make(chan struct{})
+	return ctx, true
+}
+
+func (app *App) endMessage() {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.cancel != nil {
+		app.cancel()
+		app.cancel = nil
+		close(app.ended)
+	}
+}
+
+// pendingAttachment is a file or screenshot waiting to be sent with the next
+// message. Files are read when the message is sent.
+type pendingAttachment struct {
+	name string
+	path string     // file to read, empty for screenshots
+	part genai.Part // the captured image of a screenshot
+	info Attachment
+}
+
+func (p pendingAttachment) load(ctx context.Context, provider Provider) (genai.Part, Attachment, error) {
+	if p.path == "" {
+		return p.part, p.info, nil
+	}
+	return fileAttachment(ctx, provider, p.path)
+}
+
+// addAttachment queues a file or screenshot for the next message, a file
+// which is already queued is not added again
+func (app *App) addAttachment(attachment pendingAttachment) {
+	app.mu.Lock()
+	for _, pending := range app.attachments {
+		if attachment.path != "" && pending.path == attachment.path {
+			app.mu.Unlock()
+			return
+		}
+	}
+	app.attachments = append(app.attachments, attachment)
+	app.mu.Unlock()
+	app.attachmentsChanged()
+}
+
+func (app *App) removeAttachment(i int) {
+	app.mu.Lock()
+	if i < len(app.attachments) {
+		app.attachments = append(app.attachments[:i:i], app.attachments[i+1:]...)
+	}
+	app.mu.Unlock()
+	app.attachmentsChanged()
+}
+
+// takeAttachments returns the queued attachments and empties the queue
+func (app *App) takeAttachments() []pendingAttachment {
+	app.mu.Lock()
+	attachments := app.attachments
+	app.attachments = nil
+	app.mu.Unlock()
+	app.attachmentsChanged()
+	return attachments
+}
+
+// restoreAttachments queues attachments of a message which could not be
+// sent again, in front of those added since
+func (app *App) restoreAttachments(attachments []pendingAttachment) {
+	app.mu.Lock()
+	app.attachments = append(append([]pendingAttachment{}, attachments...), app.attachments...)
+	app.mu.Unlock()
+	app.attachmentsChanged()
+}
+
+func (app *App) pendingAttachments() []pendingAttachment {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return append([]pendingAttachment{}, app.attachments...)
+}
+
+func (app *App) attachmentsChanged() {
+	if app.onAttachmentsChanged != nil {
+		app.onAttachmentsChanged()
+	}
+}
+
+// fileAttachment reads a file to be sent along with a message. Text files
+// and office documents are sent as text, files larger than uploadThreshold
+// are uploaded if the provider supports it and other binary files are refused.
+func fileAttachment(ctx context.Context, provider Provider, path string) (genai.Part, Attachment, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	fileType, err := getFileMimeType(path)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	name := filepath.Base(path)
+	attachment := Attachment{Name: name, MIMEType: baseMIMEType(fileType), Size: int(info.Size())}
+
+	if text, ok, err := documentText(path); ok {
+		if err != nil {
+			return nil, Attachment{}, err
+		}
+		attachment.MIMEType = "text/plain"
+		return textPart(name, text), attachment, nil
+	}
+	if !isBlobType(fileType) && info.Size() <= maxExtractSize {
+		fileContent, err := os.ReadFile(path)
+		if err != nil {
+			return nil, Attachment{}, err
+		}
+		if isTextFile(fileType, fileContent) {
+			text, encoding := decodeText(fileContent)
+			log.Printf("Attaching %s as text (%s)", name, encoding)
+			attachment.MIMEType = "text/plain"
+			return textPart(name, text), attachment, nil
+		}
+	}
+	if !isBlobType(fileType) {
+		return nil, Attachment{}, fmt.Errorf("%s files (%s) can't be sent to the model", filepath.Ext(name), attachment.MIMEType)
+	}
+
+	if uploader, ok := provider.(FileUploader); ok && info.Size() > uploadThreshold {
+		fileData, err := uploader.UploadFile(ctx, path, attachment.MIMEType)
+		if err != nil {
+			return nil, Attachment{}, err
+		}
+		return fileData, attachment, nil
+	}
+
+	fileContent, err := os.ReadFile(path)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	fileBlob := genai.Blob{
+		MIMEType: attachment.MIMEType,
+		Data:     fileContent,
+	}
+	return fileBlob, attachment, nil
+}
+
+// screenAttachment captures the screen to be sent along with a message, see
+// captureScreen
+func screenAttachment(ui *CaptureUI) (genai.Part, Attachment, error) {
+	imageBytes, format, err := captureScreen(ui)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	name := "screenshot." + strings.Replace(format, "jpeg", "jpg", 1)
+	return genai.ImageData(format, imageBytes), Attachment{Name: name, MIMEType: "image/" + format, Size: len(imageBytes)}, nil
+}
+
+// errorText returns the message shown in the chat for an error returned by the provider
+func errorText(err error) string {
+	var blockedErr *genai.BlockedError
+	var apiErr *apierror.APIError
+
+	if errors.Is(err, context.Canceled) {
+		return "Cancelled"
+	} else if errors.As(err, &blockedErr) {
+		return "Error: Message blocked"
+	} else if errors.As(err, &apiErr) {
+		return "Error: API error. Could not process request. Make sure your API key is set correctly."
+	}
+	log.Println("Error sending message:", err.Error())
+	return "Error: " + err.Error()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// cliOptions are the command line flags of the headless mode
+type cliOptions struct {
+	cli    bool
+	prompt string
+	file   string
+	screen bool
+}
+
+func (o cliOptions) enabled() bool {
+	return o.cli || o.prompt != ""
+}
+
+// parseCLIOptions parses the command line. ok is false for arguments we don't
+// know, macOS passes its own (-psn_...) when the app is started from Finder.
+func parseCLIOptions(args []string) (opts cliOptions, ok bool) {
+	fs := flag.NewFlagSet("theeye", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&opts.cli, "cli", false, "chat in the terminal instead of opening a window")
+	fs.StringVar(&opts.prompt, "p", "", "send a single prompt, print the answer and exit")
+	fs.StringVar(&opts.file, "f", "", "file to attach to the first message")
+	fs.BoolVar(&opts.screen, "screen", false, "attach a screenshot to the first message")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+			os.Exit(0)
+		}
+		return cliOptions{}, false
+	}
+	return opts, true
+}
+
+// runCLI chats in the terminal, either once with opts.prompt or as a REPL.
+// It returns the process exit code.
+func runCLI(opts cliOptions) int {
+	// keep stdout for the answers
+	log.SetOutput(io.Discard)
+
+	aiapp, err := newApp()
+	if aiapp == nil || aiapp.provider == nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+	defer aiapp.provider.Close()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	toolRegistry.Confirm = func(ctx context.Context, tool Tool, args map[string]any, preview string) (bool, error) {
+		fmt.Fprintf(os.Stderr, "\n%s\nAllow %s? [y/N] ", preview, tool.Name())
+		if !scanner.Scan() {
+			return false, scanner.Err()
+		}
+		answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		return answer == "y" || answer == "yes", nil
+	}
+
+	var attachments []genai.Part
+	var infos []Attachment
+	if opts.file != "" {
+		part, attachment, err := fileAttachment(context.Background(), aiapp.provider, opts.file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		attachments = append(attachments, part)
+		infos = append(infos, attachment)
+	}
+	if opts.screen {
+		part, attachment, err := screenAttachment(nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error capturing screen:", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Attached %s (%s)\n", attachment.Name, formatSize(attachment.Size))
+		attachments = append(attachments, part)
+		infos = append(infos, attachment)
+	}
+	aiapp.cs.Attach(infos...)
+
+	if opts.prompt != "" {
+		if err := cliSend(aiapp, opts.prompt, attachments); err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, "The Eye "+VERSION+" - /clear starts a new conversation, /exit or Ctrl+D quits, Ctrl+C stops an answer")
+	for {
+		fmt.Fprint(os.Stderr, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(os.Stderr)
+			return 0
+		}
+		prompt := strings.TrimSpace(scanner.Text())
+		switch prompt {
+		case "":
+			continue
+		case "/exit", "/quit":
+			return 0
+		case "/clear":
+			aiapp.cs.Reset()
+			fmt.Fprintln(os.Stderr, "Started a new conversation")
+			continue
+		}
+		cliSend(aiapp, prompt, attachments)
+		attachments = nil
+	}
+}
+
+// cliSend sends a prompt and prints the streamed answer to stdout. Ctrl+C
+// cancels the answer instead of quitting.
+func cliSend(aiapp *App, prompt string, attachments []genai.Part) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	aiapp.refreshSystemPrompt(ctx, prompt)
+	parts := append([]genai.Part{genai.Text(prompt)}, attachments...)
+	var streamed bool
+	response, err := aiapp.engine.Send(ctx, func(event Event) {
+		switch event.Type {
+		case EventAssistantDelta:
+			streamed = true
+			fmt.Print(event.Text)
+		case EventToolCallFinished:
+			if event.Tool.Err != nil {
+				fmt.Fprintf(os.Stderr, "[%s failed: %v]\n", event.Tool.Name, event.Tool.Err)
+			} else {
+				fmt.Fprintf(os.Stderr, "[%s %s]\n", event.Tool.Name, event.Tool.Duration.Round(time.Millisecond))
+			}
+		}
+	}, parts...)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if streamed {
+			fmt.Println()
+		}
+		fmt.Fprintln(os.Stderr, errorText(err))
+		return err
+	}
+	if !streamed {
+		fmt.Print(response)
+	}
+	fmt.Println()
+	return nil
+}
@@ -2,11 +2,129 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"log"
+	"net/url"
+	"strings"
 )
 
+const (
+	ProviderGemini = "gemini" // Google AI Studio through the genai SDK
+	ProviderOpenAI = "openai" // any OpenAI compatible chat completions server
+)
+
+// Usage holds the token counts reported for a single response
+type Usage struct {
+	PromptTokens int32
+	OutputTokens int32
+	TotalTokens  int32
+}
+
+// Response is a provider independent model reply
+type Response struct {
+	Parts []genai.Part
+	Usage Usage
+}
+
+// Text returns all text parts of the response joined together
+func (r *Response) Text() string {
+	var text string
+	for _, part := range r.Parts {
+		if t, ok := part.(genai.Text); ok {
+			text += string(t)
+		}
+	}
+	return text
+}
+
+// FunctionCalls returns the function call parts of the response
+func (r *Response) FunctionCalls() []genai.FunctionCall {
+	var calls []genai.FunctionCall
+	for _, part := range r.Parts {
+		if fc, ok := part.(genai.FunctionCall); ok {
+			calls = append(calls, fc)
+		}
+	}
+	return calls
+}
+
+// ChatConfig holds the options a chat session is started with
+type ChatConfig struct {
+	SystemPrompt    string
+	Tools           []*genai.Tool
+	MaxOutputTokens int32
+	Temperature     float32
+}
+
+// ChatSession is a conversation with a provider which keeps its own history
+type ChatSession interface {
+	SendMessage(ctx context.Context, parts ...genai.Part) (*Response, error)
+	// SendMessageStream calls onText with every text chunk as it arrives and
+	// returns the complete response once the stream ends
+	SendMessageStream(ctx context.Context, onText func(text string), parts ...genai.Part) (*Response, error)
+	History() []*genai.Content
+	SetHistory(history []*genai.Content)
+	// SetSystemPrompt replaces the system prompt for the following messages
+	SetSystemPrompt(prompt string)
+}
+
+// Provider is a LLM backend The Eye can chat with
+type Provider interface {
+	Name() string
+	StartChat(cfg ChatConfig) ChatSession
+	Close() error
+}
+
+// ProviderConfig selects and configures a provider, see loadProviderConfig
+type ProviderConfig struct {
+	Kind    string
+	APIKey  string
+	BaseURL string
+	Model   string
+}
+
+// NewProvider returns the provider selected in cfg
+func NewProvider(ctx context.Context, cfg ProviderConfig) (Provider, error) {
+	switch cfg.Kind {
+	case ProviderGemini, "":
+		return NewGeminiProvider(ctx, cfg.APIKey, cfg.Model)
+	case ProviderOpenAI:
+		return NewOpenAIProvider(cfg.BaseURL, cfg.APIKey, cfg.Model)
+	default:
+		return nil, fmt.Errorf("unknown provider %q", cfg.Kind)
+	}
+}
+
+// validateProviderConfig returns why a provider can't be started with cfg
+func validateProviderConfig(cfg ProviderConfig) error {
+	switch cfg.Kind {
+	case ProviderGemini, "":
+		if strings.TrimSpace(cfg.APIKey) == "" {
+			return fmt.Errorf("an API key is required for Gemini")
+		}
+	case ProviderOpenAI:
+		if strings.TrimSpace(cfg.Model) == "" {
+			return fmt.Errorf("a model name is required for the OpenAI compatible provider")
+		}
+		if cfg.BaseURL != "" {
+			u, err := url.Parse(cfg.BaseURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("server URL %q is not a http(s) URL", cfg.BaseURL)
+			}
+		}
+		// local servers don't need a key, OpenAI itself does
+		if strings.TrimSpace(cfg.APIKey) == "" && (cfg.BaseURL == "" || strings.TrimRight(cfg.BaseURL, "/") == DefaultOpenAIBaseURL) {
+			return fmt.Errorf("an API key is required for %s", DefaultOpenAIBaseURL)
+		}
+	default:
+		return fmt.Errorf("unknown provider %q", cfg.Kind)
+	}
+	return nil
+}
+
 // NewClient return new genAI client
 func NewClient(apiKey string, ctx context.Context) (*genai.Client, error) {
 	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
@@ -45,3 +163,118 @@ func closeClient(client *genai.Client) {
 		log.Println("Error closing client:", err)
 	}
 }
+
+// GeminiProvider talks to Gemini models through the genai SDK
+type GeminiProvider struct {
+	client    *genai.Client
+	modelName string
+	account   string // identifies the API key of uploaded files
+}
+
+// NewGeminiProvider return new Gemini provider, model defaults to GenaiModel
+func NewGeminiProvider(ctx context.Context, apiKey string, model string) (*GeminiProvider, error) {
+	client, err := NewClient(apiKey, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if model == "" {
+		model = GenaiModel
+	}
+	return &GeminiProvider{client: client, modelName: model, account: accountID(apiKey)}, nil
+}
+
+func (p *GeminiProvider) Name() string {
+	return ProviderGemini
+}
+
+func (p *GeminiProvider) StartChat(cfg ChatConfig) ChatSession {
+	model := NewModel(p.client, p.modelName)
+	model.Tools = cfg.Tools
+	model.SystemInstruction = &genai.Content{Role: "user", Parts: []genai.Part{genai.Text(cfg.SystemPrompt)}}
+	maxTokens := cfg.MaxOutputTokens
+	temperature := cfg.Temperature
+	model.MaxOutputTokens = &maxTokens
+	model.Temperature = &temperature
+	return &geminiChat{model: model, cs: model.StartChat()}
+}
+
+func (p *GeminiProvider) Close() error {
+	closeClient(p.client)
+	return nil
+}
+
+type geminiChat struct {
+	model *genai.GenerativeModel // the session sends with its settings
+	cs    *genai.ChatSession
+}
+
+func (c *geminiChat) SendMessage(ctx context.Context, parts ...genai.Part) (*Response, error) {
+	res, err := c.cs.SendMessage(ctx, parts...)
+	if err != nil {
+		return nil, err
+	}
+	return geminiResponse(res)
+}
+
+func (c *geminiChat) SendMessageStream(ctx context.Context, onText func(text string), parts ...genai.Part) (*Response, error) {
+	historyLen := len(c.cs.History)
+	iter := c.cs.SendMessageStream(ctx, parts...)
+
+	var usage *genai.UsageMetadata
+	for {
+		chunk, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			// drop the unanswered message so the history stays consistent
+			c.cs.History = c.cs.History[:historyLen]
+			return nil, err
+		}
+		if chunk.UsageMetadata != nil {
+			usage = chunk.UsageMetadata
+		}
+		if len(chunk.Candidates) == 0 || chunk.Candidates[0].Content == nil {
+			continue
+		}
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			if text, ok := part.(genai.Text); ok && onText != nil {
+				onText(string(text))
+			}
+		}
+	}
+
+	merged := iter.MergedResponse()
+	if merged != nil && usage != nil {
+		merged.UsageMetadata = usage
+	}
+	return geminiResponse(merged)
+}
+
+func (c *geminiChat) History() []*genai.Content {
+	return c.cs.History
+}
+
+func (c *geminiChat) SetHistory(history []*genai.Content) {
+	c.cs.History = history
+}
+
+func (c *geminiChat) SetSystemPrompt(prompt string) {
+	c.model.SystemInstruction = &genai.Content{Role: "user", Parts: []genai.Part{genai.Text(prompt)}}
+}
+
+// geminiResponse converts the first candidate of a genai response
+func geminiResponse(res *genai.GenerateContentResponse) (*Response, error) {
+	if res == nil || len(res.Candidates) == 0 || res.Candidates[0].Content == nil {
+		return nil, fmt.Errorf("empty response")
+	}
+	response := &Response{Parts: res.Candidates[0].Content.Parts}
+	if res.UsageMetadata != nil {
+		response.Usage = Usage{
+			PromptTokens: res.UsageMetadata.PromptTokenCount,
+			OutputTokens: res.UsageMetadata.CandidatesTokenCount,
+			TotalTokens:  res.UsageMetadata.TotalTokenCount,
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,61 @@
+//go:build darwin
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os/exec"
+	"strings"
+)
+
+// activeWindowBounds returns the screen bounds of the front window of the
+// frontmost app. System Events needs the accessibility permission for this.
+func activeWindowBounds() (image.Rectangle, error) {
+	script := `tell application "System Events" to tell (first application process whose frontmost is true) to get {position, size} of front window`
+	out, err := exec.Command("osascript", "-e", script).Output()
+	if err != nil {
+		return image.Rectangle{}, fmt.Errorf("osascript: %v", err)
+	}
+	var x, y, w, h int
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(out)), "%d, %d, %d, %d", &x, &y, &w, &h); err != nil {
+		return image.Rectangle{}, fmt.Errorf("unexpected window bounds %q", out)
+	}
+	return image.Rect(x, y, x+w, y+h), nil
+}
+
+// visibleWindowsScript lists the windows of visible apps as JSON
+const visibleWindowsScript = `
+var out = [];
+Application("System Events").processes.whose({visible: true})().forEach(function (p) {
+	try {
+		p.windows().forEach(function (w) {
+			var pos = w.position(), size = w.size();
+			out.push({app: p.name(), title: w.name() || "", x: pos[0], y: pos[1], w: size[0], h: size[1]});
+		});
+	} catch (e) {}
+});
+JSON.stringify(out);
+`
+
+// visibleWindows returns the windows of visible apps. System Events needs
+// the accessibility permission for this.
+func visibleWindows() ([]windowInfo, error) {
+	out, err := exec.Command("osascript", "-l", "JavaScript", "-e", visibleWindowsScript).Output()
+	if err != nil {
+		return nil, fmt.Errorf("osascript: %v", err)
+	}
+	var list []struct {
+		App, Title string
+		X, Y, W, H int
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("unexpected window list: %v", err)
+	}
+	windows := make([]windowInfo, 0, len(list))
+	for _, w := range list {
+		windows = append(windows, windowInfo{App: w.App, Title: w.Title, Bounds: image.Rect(w.X, w.Y, w.X+w.W, w.Y+w.H)})
+	}
+	return windows, nil
+}
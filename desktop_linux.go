@@ -0,0 +1,117 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+	"image"
+	"strings"
+)
+
+// activeWindowBounds returns the screen bounds of the focused window as
+// reported by the X11 window manager. Wayland sessions are not supported.
+func activeWindowBounds() (image.Rectangle, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	defer conn.Close()
+
+	root := xproto.Setup(conn).DefaultScreen(conn).Root
+	prop, err := rootProperty(conn, root, "_NET_ACTIVE_WINDOW", 1)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	if len(prop.Value) < 4 {
+		return image.Rectangle{}, errors.New("the window manager does not report the active window")
+	}
+	window := xproto.Window(xgb.Get32(prop.Value))
+	if window == 0 {
+		return image.Rectangle{}, errors.New("no window is active")
+	}
+	return windowBounds(conn, root, window)
+}
+
+// visibleWindows returns the mapped top level windows the window manager
+// knows of
+func visibleWindows() ([]windowInfo, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	root := xproto.Setup(conn).DefaultScreen(conn).Root
+	prop, err := rootProperty(conn, root, "_NET_CLIENT_LIST", 4096)
+	if err != nil {
+		return nil, err
+	}
+	if prop.Format != 32 {
+		return nil, errors.New("the window manager does not report its windows")
+	}
+	utf8String := internAtom(conn, "UTF8_STRING")
+	netWMName := internAtom(conn, "_NET_WM_NAME")
+
+	var windows []windowInfo
+	for i := 0; i+4 <= len(prop.Value); i += 4 {
+		window := xproto.Window(xgb.Get32(prop.Value[i:]))
+		attrs, err := xproto.GetWindowAttributes(conn, window).Reply()
+		if err != nil || attrs.MapState != xproto.MapStateViewable {
+			continue
+		}
+		bounds, err := windowBounds(conn, root, window)
+		if err != nil {
+			continue
+		}
+		title := stringProperty(conn, window, netWMName, utf8String)
+		if title == "" {
+			title = stringProperty(conn, window, xproto.AtomWmName, xproto.AtomString)
+		}
+		// WM_CLASS holds the instance and the class name
+		class := strings.Split(stringProperty(conn, window, xproto.AtomWmClass, xproto.AtomString), "\x00")
+		windows = append(windows, windowInfo{App: class[len(class)-1], Title: title, Bounds: bounds})
+	}
+	return windows, nil
+}
+
+func internAtom(conn *xgb.Conn, name string) xproto.Atom {
+	reply, err := xproto.InternAtom(conn, true, uint16(len(name)), name).Reply()
+	if err != nil {
+		return xproto.AtomNone
+	}
+	return reply.Atom
+}
+
+func rootProperty(conn *xgb.Conn, root xproto.Window, name string, length uint32) (*xproto.GetPropertyReply, error) {
+	atom := internAtom(conn, name)
+	if atom == xproto.AtomNone {
+		return nil, errors.New("the window manager does not support " + name)
+	}
+	return xproto.GetProperty(conn, false, root, atom, xproto.AtomWindow, 0, length).Reply()
+}
+
+func stringProperty(conn *xgb.Conn, window xproto.Window, property xproto.Atom, kind xproto.Atom) string {
+	if property == xproto.AtomNone || kind == xproto.AtomNone {
+		return ""
+	}
+	prop, err := xproto.GetProperty(conn, false, window, property, kind, 0, 1024).Reply()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(prop.Value), "\x00")
+}
+
+// windowBounds returns the screen bounds of a window
+func windowBounds(conn *xgb.Conn, root xproto.Window, window xproto.Window) (image.Rectangle, error) {
+	geometry, err := xproto.GetGeometry(conn, xproto.Drawable(window)).Reply()
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	pos, err := xproto.TranslateCoordinates(conn, window, root, 0, 0).Reply()
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return image.Rect(int(pos.DstX), int(pos.DstY), int(pos.DstX)+int(geometry.Width), int(pos.DstY)+int(geometry.Height)), nil
+}
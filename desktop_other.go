@@ -0,0 +1,16 @@
+//go:build !linux && !windows && !darwin
+
+package main
+
+import (
+	"errors"
+	"image"
+)
+
+func activeWindowBounds() (image.Rectangle, error) {
+	return image.Rectangle{}, errors.New("not supported on this platform")
+}
+
+func visibleWindows() ([]windowInfo, error) {
+	return nil, errors.New("not supported on this platform")
+}
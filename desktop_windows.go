@@ -0,0 +1,92 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"image"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	user32                         = syscall.NewLazyDLL("user32.dll")
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procGetForegroundWindow        = user32.NewProc("GetForegroundWindow")
+	procGetWindowRect              = user32.NewProc("GetWindowRect")
+	procEnumWindows                = user32.NewProc("EnumWindows")
+	procIsWindowVisible            = user32.NewProc("IsWindowVisible")
+	procIsIconic                   = user32.NewProc("IsIconic")
+	procGetWindowTextW             = user32.NewProc("GetWindowTextW")
+	procGetWindowThreadProcessId   = user32.NewProc("GetWindowThreadProcessId")
+	procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+const processQueryLimitedInformation = 0x1000
+
+// activeWindowBounds returns the screen bounds of the foreground window
+func activeWindowBounds() (image.Rectangle, error) {
+	hwnd, _, _ := procGetForegroundWindow.Call()
+	if hwnd == 0 {
+		return image.Rectangle{}, errors.New("no window is active")
+	}
+	return windowRect(hwnd)
+}
+
+// visibleWindows returns the visible top level windows which are not
+// minimized, App is the name of the executable without .exe
+func visibleWindows() ([]windowInfo, error) {
+	var windows []windowInfo
+	callback := syscall.NewCallback(func(hwnd uintptr, _ uintptr) uintptr {
+		if visible, _, _ := procIsWindowVisible.Call(hwnd); visible == 0 {
+			return 1
+		}
+		if iconic, _, _ := procIsIconic.Call(hwnd); iconic != 0 {
+			return 1
+		}
+		bounds, err := windowRect(hwnd)
+		if err != nil || bounds.Empty() {
+			return 1
+		}
+		windows = append(windows, windowInfo{App: windowProcessName(hwnd), Title: windowText(hwnd), Bounds: bounds})
+		return 1
+	})
+	if ok, _, err := procEnumWindows.Call(callback, 0); ok == 0 {
+		return nil, err
+	}
+	return windows, nil
+}
+
+func windowRect(hwnd uintptr) (image.Rectangle, error) {
+	var rect struct{ Left, Top, Right, Bottom int32 }
+	ok, _, err := procGetWindowRect.Call(hwnd, uintptr(unsafe.Pointer(&rect)))
+	if ok == 0 {
+		return image.Rectangle{}, err
+	}
+	return image.Rect(int(rect.Left), int(rect.Top), int(rect.Right), int(rect.Bottom)), nil
+}
+
+func windowText(hwnd uintptr) string {
+	buf := make([]uint16, 512)
+	n, _, _ := procGetWindowTextW.Call(hwnd, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	return syscall.UTF16ToString(buf[:n])
+}
+
+func windowProcessName(hwnd uintptr) string {
+	var pid uint32
+	procGetWindowThreadProcessId.Call(hwnd, uintptr(unsafe.Pointer(&pid)))
+	process, err := syscall.OpenProcess(processQueryLimitedInformation, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer syscall.CloseHandle(process)
+	buf := make([]uint16, syscall.MAX_PATH)
+	size := uint32(len(buf))
+	if ok, _, _ := procQueryFullProcessImageNameW.Call(uintptr(process), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size))); ok == 0 {
+		return ""
+	}
+	name := filepath.Base(syscall.UTF16ToString(buf[:size]))
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
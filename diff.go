@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	previewLimit = 2000 // characters of content shown in previews
+	diffMaxCells = 1e6  // line pairs compared before lineDiff gives up
+	diffContext  = 2    // unchanged lines kept around every change
+	diffMaxLines = 200  // diff lines shown before the rest is cut
+)
+
+// previewText shortens text for confirmation dialogs
+func previewText(text string) string {
+	if len(text) <= previewLimit {
+		return text
+	}
+	return strings.ToValidUTF8(text[:previewLimit], "") + fmt.Sprintf("\n... (%d more characters)", len(text)-previewLimit)
+}
+
+// lineDiff returns a short line based diff between two texts, lines are
+// prefixed with "-" when removed, "+" when added and " " when unchanged
+func lineDiff(oldText string, newText string) string {
+	if oldText == newText {
+		return "(no changes)"
+	}
+	a := strings.Split(oldText, "\n")
+	b := strings.Split(newText, "\n")
+	if float64(len(a))*float64(len(b)) > diffMaxCells {
+		return fmt.Sprintf("(file too large to compare: %d lines replaced by %d lines)\n\n%s", len(a), len(b), previewText(newText))
+	}
+
+	// longest common subsequence table, lcs[i][j] is the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	return collapseUnchanged(lines)
+}
+
+// collapseUnchanged keeps diffContext unchanged lines around the changes
+func collapseUnchanged(lines []string) string {
+	var out []string
+	for start := 0; start < len(lines); {
+		if lines[start][0] != ' ' {
+			out = append(out, lines[start])
+			start++
+			continue
+		}
+		end := start
+		for end < len(lines) && lines[end][0] == ' ' {
+			end++
+		}
+		keepBefore, keepAfter := diffContext, diffContext
+		if start == 0 {
+			keepBefore = 0
+		}
+		if end == len(lines) {
+			keepAfter = 0
+		}
+		if end-start > keepBefore+keepAfter+1 {
+			out = append(out, lines[start:start+keepBefore]...)
+			out = append(out, fmt.Sprintf("@@ %d unchanged lines @@", end-start-keepBefore-keepAfter))
+			out = append(out, lines[end-keepAfter:end]...)
+		} else {
+			out = append(out, lines[start:end]...)
+		}
+		start = end
+	}
+	if len(out) > diffMaxLines {
+		out = append(out[:diffMaxLines], fmt.Sprintf("... (%d more lines)", len(out)-diffMaxLines))
+	}
+	return strings.Join(out, "\n")
+}
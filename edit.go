@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrCodeEditConflict is returned when an edit does not match the file
+const ErrCodeEditConflict = "edit_conflict"
+
+var fileEditSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"fileName": {
+			Type:        genai.TypeString,
+			Description: "The name of the file to edit, including extension",
+		},
+		"edits": {
+			Type:        genai.TypeArray,
+			Description: "Search/replace blocks applied in order. Every search text must match the file exactly once, include enough surrounding lines to make it unique",
+			Items: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"search": {
+						Type:        genai.TypeString,
+						Description: "The exact text to replace, including whitespace and line breaks",
+					},
+					"replace": {
+						Type:        genai.TypeString,
+						Description: "The new text, empty to delete the search text",
+					},
+				},
+				Required: []string{"search"},
+			},
+		},
+		"diff": {
+			Type:        genai.TypeString,
+			Description: "A unified diff (@@ -line,count +line,count @@ hunks) to apply instead of edits",
+		},
+	},
+	Required: []string{"fileName"},
+}
+
+type fileEditTool struct{}
+
+func (fileEditTool) Name() string { return "file_edit" }
+
+func (fileEditTool) Description() string {
+	return "change part of a text file without rewriting all of it, with search/replace edits or a unified diff. " +
+		"Nothing is written if any edit does not match, the conflicts are returned instead."
+}
+
+func (fileEditTool) Schema() *genai.Schema { return fileEditSchema }
+
+func (fileEditTool) ReadOnly() bool { return false }
+
+func (fileEditTool) Preview(args map[string]any) string {
+	path, old, content, err := planEdit(args)
+	if err != nil {
+		return err.Error()
+	}
+	return "Edit " + path + ":\n\n" + lineDiff(old, content)
+}
+
+func (fileEditTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	path, old, content, err := planEdit(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := backupFile(path, []byte(old), true); err != nil {
+		return nil, errors.Wrap(err, "backup failed")
+	}
+	if err := writeFileAtomic(path, []byte(content)); err != nil {
+		return nil, errors.New("error writing file: " + err.Error())
+	}
+	return map[string]any{"result": "file edited: " + path}, nil
+}
+
+// planEdit reads the file of a file_edit call and applies the edits in memory
+func planEdit(args map[string]any) (path string, old string, content string, err error) {
+	fileName := args["fileName"].(string)
+	if err := checkExtension(filepath.Ext(fileName)); err != nil {
+		return "", "", "", err
+	}
+	data, err := ReadWorkspaceFile(fileName)
+	if err != nil {
+		return "", "", "", err
+	}
+	path, err = resolvePath(fileName)
+	if err != nil {
+		return "", "", "", err
+	}
+	old = string(data)
+
+	var conflicts []string
+	edits, _ := args["edits"].([]any)
+	diff, _ := args["diff"].(string)
+	switch {
+	case len(edits) > 0 && diff != "":
+		return "", "", "", errors.New("pass either edits or diff, not both")
+	case len(edits) > 0:
+		content, conflicts = applyEdits(old, edits)
+	case diff != "":
+		hunks, err := parseUnifiedDiff(diff)
+		if err != nil {
+			return "", "", "", &ToolError{Code: ErrCodeEditConflict, Message: err.Error()}
+		}
+		content, conflicts = applyHunks(old, hunks)
+	default:
+		return "", "", "", errors.New("missing edits or diff")
+	}
+	if len(conflicts) > 0 {
+		return "", "", "", &ToolError{Code: ErrCodeEditConflict, Message: "nothing was changed, read the file again and retry:\n" + strings.Join(conflicts, "\n")}
+	}
+	return path, old, content, nil
+}
+
+// applyEdits applies search/replace blocks in order, every search text must
+// match exactly once. Conflicts describe the blocks which didn't match.
+func applyEdits(content string, edits []any) (string, []string) {
+	content, crlf := toLF(content)
+	var conflicts []string
+	for i, item := range edits {
+		edit, _ := item.(map[string]any)
+		search, _ := edit["search"].(string)
+		replace, _ := edit["replace"].(string)
+		search, _ = toLF(search)
+		replace, _ = toLF(replace)
+		switch count := strings.Count(content, search); {
+		case search == "":
+			conflicts = append(conflicts, fmt.Sprintf("edit %d: empty search text", i+1))
+		case count == 0:
+			conflicts = append(conflicts, fmt.Sprintf("edit %d: search text not found%s", i+1, closestLine(content, search)))
+		case count > 1:
+			conflicts = append(conflicts, fmt.Sprintf("edit %d: search text matches %d times, include more surrounding lines", i+1, count))
+		default:
+			content = strings.Replace(content, search, replace, 1)
+		}
+	}
+	return fromLF(content, crlf), conflicts
+}
+
+// toLF returns text with CRLF line breaks replaced by LF, crlf reports
+// whether it had any. Models write LF, so edits are matched on LF text.
+func toLF(text string) (lf string, crlf bool) {
+	if !strings.Contains(text, "\r\n") {
+		return text, false
+	}
+	return strings.ReplaceAll(text, "\r\n", "\n"), true
+}
+
+// fromLF turns the LF line breaks of text back into CRLF if crlf is set
+func fromLF(text string, crlf bool) string {
+	if !crlf {
+		return text
+	}
+	return strings.ReplaceAll(text, "\n", "\r\n")
+}
+
+// closestLine hints where the first line of a search text that didn't match
+// appears in the file, ignoring indentation
+func closestLine(content string, search string) string {
+	first := strings.TrimSpace(strings.SplitN(strings.TrimLeft(search, "\n"), "\n", 2)[0])
+	if first == "" {
+		return ""
+	}
+	for i, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == first {
+			return fmt.Sprintf(", its first line is at line %d: %q", i+1, line)
+		}
+	}
+	return ""
+}
+
+// diffHunk is a hunk of a unified diff, old holds the context and removed
+// lines, new the context and added lines
+type diffHunk struct {
+	header   string
+	oldStart int
+	old      []string
+	new      []string
+}
+
+// parseUnifiedDiff parses the hunks of a unified diff of a single file, its
+// file header is skipped
+func parseUnifiedDiff(diff string) ([]diffHunk, error) {
+	diff, _ = toLF(diff)
+	lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+	var hunks []diffHunk
+	header := false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ") {
+			// a header after the first hunk starts another file
+			if header || len(hunks) > 0 {
+				return nil, fmt.Errorf("the diff has a second file header %q, edit one file per call", line)
+			}
+			header = true
+			i++
+			continue
+		}
+		if strings.HasPrefix(line, "@@") {
+			hunk := diffHunk{header: line}
+			if _, err := fmt.Sscanf(line, "@@ -%d", &hunk.oldStart); err != nil {
+				return nil, fmt.Errorf("invalid hunk header %q", line)
+			}
+			hunks = append(hunks, hunk)
+			continue
+		}
+		if len(hunks) == 0 {
+			continue
+		}
+		hunk := &hunks[len(hunks)-1]
+		switch {
+		case line == "":
+			// editors and models often drop the space of empty context lines
+			hunk.old = append(hunk.old, "")
+			hunk.new = append(hunk.new, "")
+		case line[0] == ' ':
+			hunk.old = append(hunk.old, line[1:])
+			hunk.new = append(hunk.new, line[1:])
+		case line[0] == '-':
+			hunk.old = append(hunk.old, line[1:])
+		case line[0] == '+':
+			hunk.new = append(hunk.new, line[1:])
+		case line[0] == '\\':
+			// "\ No newline at end of file"
+		default:
+			return nil, fmt.Errorf("invalid line in hunk %q: %q", hunk.header, line)
+		}
+	}
+	if len(hunks) == 0 {
+		return nil, errors.New("the diff has no @@ hunks")
+	}
+	return hunks, nil
+}
+
+// applyHunks applies the hunks in order. A hunk is placed where its old
+// lines match nearest to the line number of its header, so diffs made
+// against a slightly different version still apply.
+func applyHunks(content string, hunks []diffHunk) (string, []string) {
+	content, crlf := toLF(content)
+	lines := strings.Split(content, "\n")
+	var conflicts []string
+	offset := 0 // lines added minus lines removed by the previous hunks
+	for i, hunk := range hunks {
+		anchor := hunk.oldStart - 1
+		if len(hunk.old) == 0 {
+			// a pure insertion goes after line oldStart
+			anchor = hunk.oldStart
+		}
+		pos := findLines(lines, hunk.old, min(max(anchor+offset, 0), len(lines)))
+		if pos < 0 {
+			conflicts = append(conflicts, fmt.Sprintf("hunk %d (%s): the old lines do not match the file", i+1, hunk.header))
+			continue
+		}
+		lines = slices.Replace(lines, pos, pos+len(hunk.old), hunk.new...)
+		offset = pos - anchor + len(hunk.new) - len(hunk.old)
+	}
+	return fromLF(strings.Join(lines, "\n"), crlf), conflicts
+}
+
+// findLines returns the position of want in lines nearest to expected, or -1
+func findLines(lines []string, want []string, expected int) int {
+	if len(want) == 0 {
+		return expected
+	}
+	best := -1
+	for pos := 0; pos+len(want) <= len(lines); pos++ {
+		if !slices.Equal(lines[pos:pos+len(want)], want) {
+			continue
+		}
+		if best < 0 || abs(pos-expected) < abs(best-expected) {
+			best = pos
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
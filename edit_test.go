@@ -0,0 +1,239 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyEdits(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		edits     []any
+		want      string
+		conflicts []string // substrings of the expected conflicts
+	}{
+		{
+			name:    "single edit",
+			content: "a\nb\nc\n",
+			edits:   []any{map[string]any{"search": "b\n", "replace": "B\n"}},
+			want:    "a\nB\nc\n",
+		},
+		{
+			name:    "edits apply in order",
+			content: "one two",
+			edits: []any{
+				map[string]any{"search": "one", "replace": "three"},
+				map[string]any{"search": "three two", "replace": "done"},
+			},
+			want: "done",
+		},
+		{
+			name:    "delete",
+			content: "keep\ndrop\n",
+			edits:   []any{map[string]any{"search": "drop\n"}},
+			want:    "keep\n",
+		},
+		{
+			name:      "ambiguous search text",
+			content:   "x = 1\nx = 1\n",
+			edits:     []any{map[string]any{"search": "x = 1", "replace": "x = 2"}},
+			conflicts: []string{"edit 1: search text matches 2 times"},
+		},
+		{
+			name:      "missing search text",
+			content:   "func a() {\n\treturn 1\n}\n",
+			edits:     []any{map[string]any{"search": "func a() {\n  return 2\n}", "replace": ""}},
+			conflicts: []string{"edit 1: search text not found, its first line is at line 1"},
+		},
+		{
+			name:      "empty search text",
+			content:   "a",
+			edits:     []any{map[string]any{"search": "", "replace": "b"}},
+			conflicts: []string{"edit 1: empty search text"},
+		},
+		{
+			name:    "all conflicts are reported",
+			content: "a\n",
+			edits: []any{
+				map[string]any{"search": "b", "replace": "c"},
+				map[string]any{"search": "d", "replace": "e"},
+			},
+			conflicts: []string{"edit 1: search text not found", "edit 2: search text not found"},
+		},
+		{
+			name:    "CRLF file with LF edits",
+			content: "a\r\nb\r\nc\r\n",
+			edits:   []any{map[string]any{"search": "a\nb\n", "replace": "a\nB\nb2\n"}},
+			want:    "a\r\nB\r\nb2\r\nc\r\n",
+		},
+		{
+			name:    "no trailing newline",
+			content: "a\nb",
+			edits:   []any{map[string]any{"search": "b", "replace": "c"}},
+			want:    "a\nc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts := applyEdits(tt.content, tt.edits)
+			checkConflicts(t, conflicts, tt.conflicts)
+			if len(tt.conflicts) == 0 && got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkConflicts fails unless there is a conflict containing each of want
+func checkConflicts(t *testing.T, conflicts []string, want []string) {
+	t.Helper()
+	if len(conflicts) != len(want) {
+		t.Fatalf("conflicts = %q, want %d", conflicts, len(want))
+	}
+	for i := range want {
+		if !strings.Contains(conflicts[i], want[i]) {
+			t.Errorf("conflict %d = %q, want it to contain %q", i+1, conflicts[i], want[i])
+		}
+	}
+}
+
+func TestParseUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		diff    string
+		hunks   int
+		wantErr string
+	}{
+		{
+			name:  "with file header",
+			diff:  "--- a/main.go\n+++ b/main.go\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n",
+			hunks: 1,
+		},
+		{
+			name:  "without file header",
+			diff:  "@@ -1 +1 @@\n-a\n+b\n@@ -5 +5 @@\n-e\n+f\n",
+			hunks: 2,
+		},
+		{
+			name:    "two files",
+			diff:    "--- a/one.go\n+++ b/one.go\n@@ -1 +1 @@\n-a\n+b\n--- a/two.go\n+++ b/two.go\n@@ -1 +1 @@\n-c\n+d\n",
+			wantErr: "second file header",
+		},
+		{
+			name:    "second file without a header first",
+			diff:    "@@ -1 +1 @@\n-a\n+b\n--- a/two.go\n+++ b/two.go\n@@ -1 +1 @@\n-c\n+d\n",
+			wantErr: "second file header",
+		},
+		{
+			name:    "no hunks",
+			diff:    "--- a/main.go\n+++ b/main.go\n",
+			wantErr: "no @@ hunks",
+		},
+		{
+			name:    "invalid hunk header",
+			diff:    "@@ -x +1 @@\n-a\n",
+			wantErr: "invalid hunk header",
+		},
+		{
+			name:    "invalid line",
+			diff:    "@@ -1 +1 @@\n-a\n*b\n",
+			wantErr: "invalid line",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hunks, err := parseUnifiedDiff(tt.diff)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hunks) != tt.hunks {
+				t.Errorf("got %d hunks, want %d", len(hunks), tt.hunks)
+			}
+		})
+	}
+}
+
+func TestApplyHunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		diff      string
+		want      string
+		conflicts []string
+	}{
+		{
+			name:    "replace a line",
+			content: "a\nb\nc\n",
+			diff:    "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+			want:    "a\nB\nc\n",
+		},
+		{
+			name:    "drifted line numbers",
+			content: "1\n2\n3\nx\ny\nz\n",
+			diff:    "@@ -20,3 +20,3 @@\n x\n-y\n+Y\n z\n",
+			want:    "1\n2\n3\nx\nY\nz\n",
+		},
+		{
+			name:    "nearest match to the line number",
+			content: "x\ny\n...\nx\ny\n",
+			diff:    "@@ -4,2 +4,2 @@\n x\n-y\n+Y\n",
+			want:    "x\ny\n...\nx\nY\n",
+		},
+		{
+			name:    "second hunk follows the first",
+			content: "a\nb\nc\nd\n",
+			diff:    "@@ -1 +1,2 @@\n-a\n+a1\n+a2\n@@ -4 +5 @@\n-d\n+D\n",
+			want:    "a1\na2\nb\nc\nD\n",
+		},
+		{
+			name:    "pure insertion",
+			content: "a\nb\n",
+			diff:    "@@ -1,0 +2 @@\n+inserted\n",
+			want:    "a\ninserted\nb\n",
+		},
+		{
+			name:    "no trailing newline",
+			content: "a\nb",
+			diff:    "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+			want:    "a\nc",
+		},
+		{
+			name:    "CRLF file with LF diff",
+			content: "a\r\nb\r\nc\r\n",
+			diff:    "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+			want:    "a\r\nB\r\nc\r\n",
+		},
+		{
+			name:    "CRLF diff",
+			content: "a\nb\n",
+			diff:    "@@ -1,2 +1,2 @@\r\n a\r\n-b\r\n+B\r\n",
+			want:    "a\nB\n",
+		},
+		{
+			name:      "old lines don't match",
+			content:   "a\nb\n",
+			diff:      "@@ -1,2 +1,2 @@\n a\n-c\n+C\n",
+			conflicts: []string{"hunk 1 (@@ -1,2 +1,2 @@): the old lines do not match"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hunks, err := parseUnifiedDiff(tt.diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, conflicts := applyHunks(tt.content, hunks)
+			checkConflicts(t, conflicts, tt.conflicts)
+			if len(tt.conflicts) == 0 && got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
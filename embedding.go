@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Memory embedding modes, stored in the memory_embeddings setting
+const (
+	EmbeddingsProvider = "provider" // the provider's embedding model, local if it has none
+	EmbeddingsLocal    = "local"    // localEmbedder only
+	EmbeddingsOff      = "off"      // keyword search only
+)
+
+const (
+	GeminiEmbeddingModel = "text-embedding-004"
+	embeddingBatchSize   = 100 // texts per embedding request
+	embeddingTimeout     = 15 * time.Second
+	localEmbeddingDims   = 256
+
+	// cosine similarity a memory item needs to count as related, vectors of
+	// the local embedder are only similar if the texts share words
+	minSimilarity      = 0.5
+	minLocalSimilarity = 0.2
+)
+
+// Embedder is implemented by providers which can compute embedding vectors.
+// EmbeddingModel names the vector space, vectors of different models are
+// never compared. query is true for search queries and false for the
+// documents searched, some models embed them differently.
+type Embedder interface {
+	EmbeddingModel() string
+	Embed(ctx context.Context, texts []string, query bool) ([][]float32, error)
+}
+
+// EmbeddingModel names the Gemini embedding model
+func (p *GeminiProvider) EmbeddingModel() string {
+	return ProviderGemini + "/" + GeminiEmbeddingModel
+}
+
+func (p *GeminiProvider) Embed(ctx context.Context, texts []string, query bool) ([][]float32, error) {
+	model := p.client.EmbeddingModel(GeminiEmbeddingModel)
+	model.TaskType = genai.TaskTypeRetrievalDocument
+	if query {
+		model.TaskType = genai.TaskTypeRetrievalQuery
+	}
+	var vectors [][]float32
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		batch := model.NewBatch()
+		for _, text := range texts[start:min(start+embeddingBatchSize, len(texts))] {
+			batch.AddContent(genai.Text(text))
+		}
+		res, err := model.BatchEmbedContents(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, embedding := range res.Embeddings {
+			vectors = append(vectors, embedding.Values)
+		}
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings for %d texts", len(vectors), len(texts))
+	}
+	return vectors, nil
+}
+
+// EmbeddingModel names the model of the openai_embedding_model setting, it
+// is empty if none is set as servers have no common embedding model
+func (p *OpenAIProvider) EmbeddingModel() string {
+	model := GetSetting(db, "openai_embedding_model", "")
+	if model == "" {
+		return ""
+	}
+	return ProviderOpenAI + "/" + model
+}
+
+func (p *OpenAIProvider) Embed(ctx context.Context, texts []string, query bool) ([][]float32, error) {
+	model := GetSetting(db, "openai_embedding_model", "")
+	if model == "" {
+		return nil, fmt.Errorf("no embedding model set")
+	}
+	var vectors [][]float32
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		batch := texts[start:min(start+embeddingBatchSize, len(texts))]
+		var res struct {
+			Data []struct {
+				Index     int       `json:"index"`
+				Embedding []float32 `json:"embedding"`
+			} `json:"data"`
+		}
+		if err := p.post(ctx, "/embeddings", map[string]any{"model": model, "input": batch}, &res); err != nil {
+			return nil, err
+		}
+		if len(res.Data) != len(batch) {
+			return nil, fmt.Errorf("got %d embeddings for %d texts", len(res.Data), len(batch))
+		}
+		sort.Slice(res.Data, func(i, j int) bool { return res.Data[i].Index < res.Data[j].Index })
+		for _, data := range res.Data {
+			vectors = append(vectors, data.Embedding)
+		}
+	}
+	return vectors, nil
+}
+
+// localEmbedder hashes the words and character trigrams of a text into a
+// vector. It is deterministic and needs no network, but only relates texts
+// sharing words or parts of words, not paraphrases.
+type localEmbedder struct{}
+
+func (localEmbedder) EmbeddingModel() string {
+	return fmt.Sprintf("local/hash-%d", localEmbeddingDims)
+}
+
+func (localEmbedder) Embed(ctx context.Context, texts []string, query bool) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, localEmbeddingDims)
+		add := func(feature string, weight float32) {
+			h := fnv.New32a()
+			h.Write([]byte(feature))
+			sum := h.Sum32()
+			// the top bit decides the sign so collisions tend to cancel out
+			if sum&(1<<31) != 0 {
+				weight = -weight
+			}
+			vector[sum%localEmbeddingDims] += weight
+		}
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			if memoryStopWords[word] {
+				continue
+			}
+			add(word, 1)
+			padded := []rune("#" + word + "#")
+			for j := 0; j+3 <= len(padded); j++ {
+				add(string(padded[j:j+3]), 0.5)
+			}
+		}
+		vectors[i] = normalize(vector)
+	}
+	return vectors, nil
+}
+
+var (
+	embeddingMu       sync.Mutex
+	embeddingProvider Provider // the provider of the chat, see setEmbeddingProvider
+	lastQuery         struct { // the query embedded last, see queryVector
+		model, text string
+		vector      []float32
+	}
+	lastIndex *memoryIndex // see indexedMemory
+)
+
+// memoryIndex is the memory with the vectors of one embedding model as it
+// was at a memoryVersion
+type memoryIndex struct {
+	model   string
+	version uint64
+	items   []UserData
+	vectors map[uint][]float32
+}
+
+// setEmbeddingProvider sets the provider whose embedding model is used for memory
+func setEmbeddingProvider(provider Provider) {
+	embeddingMu.Lock()
+	defer embeddingMu.Unlock()
+	embeddingProvider = provider
+}
+
+// memoryEmbedder returns the embedder chosen in settings, nil if embeddings are off
+func memoryEmbedder() Embedder {
+	switch GetSetting(db, "memory_embeddings", EmbeddingsProvider) {
+	case EmbeddingsOff:
+		return nil
+	case EmbeddingsLocal:
+		return localEmbedder{}
+	}
+	embeddingMu.Lock()
+	defer embeddingMu.Unlock()
+	if embedder, ok := embeddingProvider.(Embedder); ok && embedder.EmbeddingModel() != "" {
+		return embedder
+	}
+	return localEmbedder{}
+}
+
+// semanticSearch returns up to limit memory items related in meaning to
+// query, the most similar first
+func semanticSearch(ctx context.Context, embedder Embedder, query string, limit int) ([]UserData, error) {
+	items, vectors, err := indexedMemory(ctx, embedder)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	queryVector, err := queryVector(ctx, embedder, query)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := float32(minSimilarity)
+	if _, ok := embedder.(localEmbedder); ok {
+		threshold = minLocalSimilarity
+	}
+	similarity := map[uint]float32{}
+	var related []UserData
+	for _, item := range items {
+		if s := cosine(queryVector, vectors[item.ID]); s >= threshold {
+			similarity[item.ID] = s
+			related = append(related, item)
+		}
+	}
+	sort.SliceStable(related, func(i, j int) bool {
+		return similarity[related[i].ID] > similarity[related[j].ID]
+	})
+	return related[:min(limit, len(related))], nil
+}
+
+// indexedMemory returns the memory items and their vectors. They are kept
+// until memory changes, so searching for every message doesn't load the
+// whole memory again.
+func indexedMemory(ctx context.Context, embedder Embedder) ([]UserData, map[uint][]float32, error) {
+	model := embedder.EmbeddingModel()
+	version := memoryVersion.Load()
+	embeddingMu.Lock()
+	if index := lastIndex; index != nil && index.model == model && index.version == version {
+		embeddingMu.Unlock()
+		return index.items, index.vectors, nil
+	}
+	embeddingMu.Unlock()
+
+	items, err := ListData(db, "", -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	vectors, err := memoryVectors(ctx, embedder, items)
+	if err != nil {
+		return nil, nil, err
+	}
+	embeddingMu.Lock()
+	defer embeddingMu.Unlock()
+	lastIndex = &memoryIndex{model: model, version: version, items: items, vectors: vectors}
+	return items, vectors, nil
+}
+
+// queryVector returns the vector of a search query. The last one is kept as
+// the message of a turn is searched again by retries and memory_search.
+func queryVector(ctx context.Context, embedder Embedder, query string) ([]float32, error) {
+	model := embedder.EmbeddingModel()
+	embeddingMu.Lock()
+	if lastQuery.model == model && lastQuery.text == query {
+		defer embeddingMu.Unlock()
+		return lastQuery.vector, nil
+	}
+	embeddingMu.Unlock()
+
+	vectors, err := embedder.Embed(ctx, []string{query}, true)
+	if err != nil {
+		return nil, err
+	}
+	embeddingMu.Lock()
+	defer embeddingMu.Unlock()
+	lastQuery.model, lastQuery.text, lastQuery.vector = model, query, vectors[0]
+	return vectors[0], nil
+}
+
+// memoryVectors returns the vectors of items by ID. Vectors missing or
+// computed from an older text are computed and stored.
+func memoryVectors(ctx context.Context, embedder Embedder, items []UserData) (map[uint][]float32, error) {
+	model := embedder.EmbeddingModel()
+	stored, err := ListEmbeddings(db, model)
+	if err != nil {
+		return nil, err
+	}
+	known := map[uint]MemoryEmbedding{}
+	for _, embedding := range stored {
+		known[embedding.DataID] = embedding
+	}
+
+	vectors := map[uint][]float32{}
+	var missing []MemoryEmbedding
+	var texts []string
+	for _, item := range items {
+		text := memoryText(item)
+		hash := textHash(text)
+		if embedding, ok := known[item.ID]; ok && embedding.TextHash == hash {
+			vectors[item.ID] = decodeVector(embedding.Vector)
+			continue
+		}
+		missing = append(missing, MemoryEmbedding{DataID: item.ID, Model: model, TextHash: hash})
+		texts = append(texts, text)
+	}
+	if len(missing) == 0 {
+		return vectors, nil
+	}
+
+	log.Printf("Computing %d memory embeddings with %s", len(missing), model)
+	computed, err := embedder.Embed(ctx, texts, false)
+	if err != nil {
+		return nil, err
+	}
+	for i := range missing {
+		missing[i].Vector = encodeVector(computed[i])
+		vectors[missing[i].DataID] = computed[i]
+	}
+	if err := SaveEmbeddings(db, missing); err != nil {
+		log.Println("Error saving memory embeddings:", err)
+	}
+	return vectors, nil
+}
+
+// memoryText is the text of a memory item which is embedded
+func memoryText(item UserData) string {
+	return item.Title + ": " + item.Description + " - " + item.Value
+}
+
+func textHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:8])
+}
+
+func cosine(a []float32, b []float32) float32 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return float32(dot / math.Sqrt(normA*normB))
+}
+
+func normalize(vector []float32) []float32 {
+	var sum float64
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return vector
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
+
+// encodeVector stores a vector as little endian float32s
+func encodeVector(vector []float32) []byte {
+	data := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	return data
+}
+
+func decodeVector(data []byte) []float32 {
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vector
+}
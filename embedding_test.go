@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCosine(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float32
+		want float32
+	}{
+		{"same", []float32{1, 2, 3}, []float32{1, 2, 3}, 1},
+		{"scaled", []float32{1, 2}, []float32{2, 4}, 1},
+		{"opposite", []float32{1, 0}, []float32{-1, 0}, -1},
+		{"orthogonal", []float32{1, 0}, []float32{0, 1}, 0},
+		{"zero vector", []float32{0, 0}, []float32{1, 1}, 0},
+		{"different lengths", []float32{1, 0}, []float32{1, 0, 0}, 0},
+		{"empty", nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cosine(tt.a, tt.b); math.Abs(float64(got-tt.want)) > 1e-6 {
+				t.Errorf("cosine = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalEmbedderDeterministic(t *testing.T) {
+	texts := []string{"My favourite colour is blue", "The car is a red Toyota", ""}
+	first, err := localEmbedder{}.Embed(context.Background(), texts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := localEmbedder{}.Embed(context.Background(), texts, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Error("the same texts got different vectors")
+	}
+	for i, vector := range first[:2] {
+		if len(vector) != localEmbeddingDims {
+			t.Fatalf("vector %d has %d dimensions", i, len(vector))
+		}
+		if s := cosine(vector, vector); math.Abs(float64(s-1)) > 1e-5 {
+			t.Errorf("vector %d is not normalized", i)
+		}
+	}
+	if cosine(first[0], first[1]) >= minLocalSimilarity {
+		t.Errorf("unrelated texts have similarity %v", cosine(first[0], first[1]))
+	}
+}
+
+// fakeEmbedder gives each text the vector of a word of vectors it
+// contains, the zero vector if there is none
+type fakeEmbedder struct {
+	vectors   map[string][]float32
+	queries   atomic.Int32  // texts embedded as queries
+	documents atomic.Int32  // texts embedded as documents
+	delay     time.Duration // before embedding
+}
+
+func (e *fakeEmbedder) EmbeddingModel() string { return "fake" }
+
+func (e *fakeEmbedder) Embed(ctx context.Context, texts []string, query bool) ([][]float32, error) {
+	if query {
+		e.queries.Add(int32(len(texts)))
+	} else {
+		e.documents.Add(int32(len(texts)))
+	}
+	select {
+	case <-time.After(e.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	result := make([][]float32, len(texts))
+	for i, text := range texts {
+		result[i] = []float32{0, 0}
+		for word, vector := range e.vectors {
+			if strings.Contains(text, word) {
+				result[i] = vector
+			}
+		}
+	}
+	return result, nil
+}
+
+// useTestMemory saves memory items for the titles and resets the query
+// vector kept by queryVector
+func useTestMemory(t *testing.T, titles ...string) {
+	t.Helper()
+	useTestDB(t)
+	for _, title := range titles {
+		if _, err := UpsertData(db, UserData{Title: title, Description: "test", Value: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	embeddingMu.Lock()
+	lastQuery.model, lastQuery.text, lastQuery.vector = "", "", nil
+	embeddingMu.Unlock()
+}
+
+func titles(items []UserData) []string {
+	var titles []string
+	for _, item := range items {
+		titles = append(titles, item.Title)
+	}
+	return titles
+}
+
+func TestSemanticSearch(t *testing.T) {
+	useTestMemory(t, "cat", "dog", "car", "kitten")
+	embedder := &fakeEmbedder{vectors: map[string][]float32{
+		"cat":    {1, 0},
+		"kitten": {0.9, 0.1},
+		"dog":    {0.6, 0.8},
+		"car":    {0, 1}, // below minSimilarity
+		"pets":   {1, 0},
+	}}
+
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{10, []string{"cat", "kitten", "dog"}},
+		{2, []string{"cat", "kitten"}},
+	}
+	for _, tt := range tests {
+		items, err := semanticSearch(context.Background(), embedder, "pets", tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := titles(items); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("limit %d: got %v, want %v", tt.limit, got, tt.want)
+		}
+	}
+	if n := embedder.queries.Load(); n != 1 {
+		t.Errorf("the query was embedded %d times, want once", n)
+	}
+}
+
+func TestSemanticSearchIndex(t *testing.T) {
+	useTestMemory(t, "cat", "dog")
+	embedder := &fakeEmbedder{vectors: map[string][]float32{"cat": {1, 0}, "kitten": {1, 0}, "dog": {0.8, 0.6}, "pets": {1, 0}}}
+	search := func() []UserData {
+		t.Helper()
+		items, err := semanticSearch(context.Background(), embedder, "pets", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	search()
+	// the vectors of unchanged memory are not loaded again
+	if err := db.Exec("DELETE FROM memory_embeddings").Error; err != nil {
+		t.Fatal(err)
+	}
+	if got := titles(search()); !reflect.DeepEqual(got, []string{"cat", "dog"}) {
+		t.Errorf("got %v, want cat, dog", got)
+	}
+	if n := embedder.documents.Load(); n != 2 {
+		t.Errorf("embedded %d memory items, want 2", n)
+	}
+
+	// changes of the memory are seen by the next search
+	if _, err := UpsertData(db, UserData{Title: "kitten", Value: "kitten"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteDataByTitle(db, "cat"); err != nil {
+		t.Fatal(err)
+	}
+	dog, _ := GetData(db, "dog")
+	if err := SetDataPinned(db, dog.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	items := search()
+	if got := titles(items); !reflect.DeepEqual(got, []string{"kitten", "dog"}) {
+		t.Errorf("got %v, want kitten, dog", got)
+	}
+	if len(items) == 2 && !items[1].Pinned {
+		t.Error("dog is not pinned")
+	}
+}
+
+func TestSemanticSearchLocal(t *testing.T) {
+	useTestMemory(t, "favourite colour", "car model", "favourite food")
+	items, err := semanticSearch(context.Background(), localEmbedder{}, "what is my favourite colour", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := titles(items)
+	if len(got) == 0 || got[0] != "favourite colour" {
+		t.Fatalf("got %v, want favourite colour first", got)
+	}
+	for _, title := range got {
+		if title == "car model" {
+			t.Errorf("got %v, car model is unrelated", got)
+		}
+	}
+}
+
+// embeddingProviderStub is a chat provider which can compute embeddings
+type embeddingProviderStub struct {
+	*FakeProvider
+	*fakeEmbedder
+}
+
+func TestSearchMemoryDoesNotWaitForEmbeddings(t *testing.T) {
+	useTestMemory(t, "cat food", "dog")
+	embedder := &fakeEmbedder{vectors: map[string][]float32{"dog": {1, 0}, "puppy": {1, 0}}, delay: time.Second}
+	setEmbeddingProvider(embeddingProviderStub{NewFakeProvider(), embedder})
+	t.Cleanup(func() { setEmbeddingProvider(nil) })
+
+	start := time.Now()
+	items, err := searchMemory(context.Background(), "puppy food", 10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("searchMemory took %v", elapsed)
+	}
+	if got := titles(items); !reflect.DeepEqual(got, []string{"cat food"}) {
+		t.Errorf("got %v, want only the keyword match", got)
+	}
+
+	// waiting long enough gives the related item first
+	items, err = searchMemory(context.Background(), "puppy food", 10, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := titles(items); !reflect.DeepEqual(got, []string{"dog", "cat food"}) {
+		t.Errorf("got %v, want dog, cat food", got)
+	}
+}
+
+func TestSearchMemoryStoresVectorsAfterStop(t *testing.T) {
+	useTestMemory(t, "cat", "dog")
+	embedder := &fakeEmbedder{vectors: map[string][]float32{"cat": {1, 0}}, delay: 100 * time.Millisecond}
+	setEmbeddingProvider(embeddingProviderStub{NewFakeProvider(), embedder})
+	t.Cleanup(func() { setEmbeddingProvider(nil) })
+
+	// the user stops the message while the vectors are computed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := searchMemory(ctx, "cats", 10, embeddingTimeout); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		embeddings, err := ListEmbeddings(db, embedder.EmbeddingModel())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(embeddings) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d vectors stored, want 2", len(embeddings))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"log"
+	"time"
+)
+
+// EventType identifies what happened during ChatEngine.Send
+type EventType int
+
+const (
+	EventUserMessage      EventType = iota // the user message was sent, Text holds its text
+	EventAssistantDelta                    // a chunk of streamed assistant text
+	EventToolCallStarted                   // the model requested a tool call, Tool is set
+	EventToolCallFinished                  // a tool call returned, Tool holds the result
+	EventError                             // sending failed, Err is set
+	EventDone                              // the model answered, Text holds the final answer
+)
+
+// Event is passed to the callback of ChatEngine.Send
+type Event struct {
+	Type EventType
+	Text string
+	Tool *ToolCall
+	Err  error
+}
+
+// ToolCall is a single function call requested by the model
+type ToolCall struct {
+	Name     string
+	Args     map[string]any
+	Result   map[string]any
+	Err      error
+	Duration time.Duration
+}
+
+// response returns the function response sent back to the model
+func (c *ToolCall) response() map[string]any {
+	var toolErr *ToolError
+	if errors.As(c.Err, &toolErr) {
+		return map[string]any{"error": toolErr.Message, "code": toolErr.Code}
+	}
+	if c.Err != nil {
+		return map[string]any{"error": c.Err.Error()}
+	}
+	if c.Result == nil {
+		return map[string]any{}
+	}
+	return c.Result
+}
+
+// ToolHandler executes a function call requested by the model
+type ToolHandler func(ctx context.Context, call genai.FunctionCall) (map[string]any, error)
+
+// DefaultMaxToolRounds is used when the max_tool_rounds setting is not set
+const DefaultMaxToolRounds = 10
+
+// ChatEngine runs the send and tool call loop of a chat session without
+// depending on any UI. Front ends follow a turn through the events.
+type ChatEngine struct {
+	session ChatSession
+	tools   ToolHandler
+
+	// MaxToolRounds limits how many times per message the model may call tools
+	MaxToolRounds int
+}
+
+func NewChatEngine(session ChatSession, tools ToolHandler) *ChatEngine {
+	return &ChatEngine{session: session, tools: tools, MaxToolRounds: DefaultMaxToolRounds}
+}
+
+// Send sends a user message and executes tool calls until the model answers
+// with text only. The final answer is returned and reported with EventDone.
+func (e *ChatEngine) Send(ctx context.Context, onEvent func(event Event), parts ...genai.Part) (string, error) {
+	emit := func(event Event) {
+		if onEvent != nil {
+			onEvent(event)
+		}
+	}
+	onText := func(text string) {
+		emit(Event{Type: EventAssistantDelta, Text: text})
+	}
+
+	emit(Event{Type: EventUserMessage, Text: (&Response{Parts: parts}).Text()})
+	resp, err := e.session.SendMessageStream(ctx, onText, parts...)
+	if err != nil {
+		emit(Event{Type: EventError, Err: err})
+		return "", err
+	}
+
+	for round := 1; ; round++ {
+		calls := resp.FunctionCalls()
+		if len(calls) == 0 {
+			break
+		}
+		if round > e.MaxToolRounds+1 {
+			err := fmt.Errorf("stopped after %d rounds of tool calls", e.MaxToolRounds)
+			e.stop(calls, nil, err)
+			emit(Event{Type: EventError, Err: err})
+			return "", err
+		}
+
+		// every call gets its own response, in the order the model asked for them
+		var funcResponses []genai.Part
+		for _, functionCall := range calls {
+			if err := ctx.Err(); err != nil {
+				e.stop(calls, funcResponses, err)
+				emit(Event{Type: EventError, Err: err})
+				return "", err
+			}
+			call := &ToolCall{Name: functionCall.Name, Args: functionCall.Args}
+			emit(Event{Type: EventToolCallStarted, Tool: call})
+
+			start := time.Now()
+			if round > e.MaxToolRounds {
+				// answer the calls so the history stays valid and ask for a final answer
+				call.Err = fmt.Errorf("not executed, the limit of %d tool rounds is reached. Answer the user with what you have", e.MaxToolRounds)
+			} else {
+				call.Result, call.Err = e.tools(ctx, functionCall)
+			}
+			call.Duration = time.Since(start)
+			emit(Event{Type: EventToolCallFinished, Tool: call})
+
+			funcResponses = append(funcResponses, genai.FunctionResponse{
+				Name:     functionCall.Name,
+				Response: call.response(),
+			})
+		}
+
+		if resp.Text() != "" {
+			onText("\n\n")
+		}
+		resp, err = e.session.SendMessageStream(ctx, onText, funcResponses...)
+		if err != nil {
+			// the session dropped the unsent responses
+			e.stop(calls, funcResponses, err)
+			emit(Event{Type: EventError, Err: err})
+			return "", err
+		}
+	}
+
+	response := resp.Text()
+	log.Println("Response:", response)
+	emit(Event{Type: EventDone, Text: response})
+	return response, nil
+}
+
+// historyAppender is implemented by sessions which save turns added to
+// their history without sending them
+type historyAppender interface {
+	AppendHistory(contents ...*genai.Content)
+}
+
+// stop ends a turn whose tool calls can't be completed. Every function call
+// must be followed by its response, so the calls without one in answered are
+// answered with err and a model turn saying why the turn stopped is added.
+func (e *ChatEngine) stop(calls []genai.FunctionCall, answered []genai.Part, err error) {
+	responses := append([]genai.Part{}, answered...)
+	for _, call := range calls[len(answered):] {
+		responses = append(responses, genai.FunctionResponse{
+			Name:     call.Name,
+			Response: map[string]any{"error": "not executed: " + err.Error()},
+		})
+	}
+	contents := []*genai.Content{
+		{Role: "user", Parts: responses},
+		{Role: "model", Parts: []genai.Part{genai.Text("Stopped: " + err.Error())}},
+	}
+	if appender, ok := e.session.(historyAppender); ok {
+		appender.AppendHistory(contents...)
+		return
+	}
+	e.session.SetHistory(append(e.session.History(), contents...))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/google/generative-ai-go/genai"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// callResponse returns a scripted model turn asking for the calls
+func callResponse(text string, names ...string) *Response {
+	res := &Response{}
+	if text != "" {
+		res.Parts = append(res.Parts, genai.Text(text))
+	}
+	for _, name := range names {
+		res.Parts = append(res.Parts, genai.FunctionCall{Name: name, Args: map[string]any{"name": name}})
+	}
+	return res
+}
+
+func textResponse(text string) *Response {
+	return &Response{Parts: []genai.Part{genai.Text(text)}}
+}
+
+// checkToolHistory fails if a model turn with function calls is not
+// followed by a turn answering every call
+func checkToolHistory(t *testing.T, history []*genai.Content) {
+	t.Helper()
+	for i, content := range history {
+		var calls []string
+		for _, part := range content.Parts {
+			if call, ok := part.(genai.FunctionCall); ok {
+				calls = append(calls, call.Name)
+			}
+		}
+		if len(calls) == 0 {
+			continue
+		}
+		if i+1 == len(history) {
+			t.Fatalf("turn %d: calls %v are not answered", i, calls)
+		}
+		var responses []string
+		for _, part := range history[i+1].Parts {
+			if response, ok := part.(genai.FunctionResponse); ok {
+				responses = append(responses, response.Name)
+			}
+		}
+		if !reflect.DeepEqual(calls, responses) {
+			t.Fatalf("turn %d: calls %v are answered by %v", i, calls, responses)
+		}
+	}
+}
+
+func TestSendAnswersEveryCallInOrder(t *testing.T) {
+	chat := NewFakeProvider(callResponse("", "first", "second", "third"), textResponse("all done")).StartChat(ChatConfig{}).(*FakeChat)
+	var ran []string
+	engine := NewChatEngine(chat, func(ctx context.Context, call genai.FunctionCall) (map[string]any, error) {
+		ran = append(ran, call.Name)
+		if call.Name == "second" {
+			return nil, errors.New("second failed")
+		}
+		return map[string]any{"result": call.Name}, nil
+	})
+
+	answer, err := engine.Send(context.Background(), nil, genai.Text("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "all done" {
+		t.Errorf("answer = %q", answer)
+	}
+	if want := []string{"first", "second", "third"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	if len(chat.Sent) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(chat.Sent))
+	}
+	want := []genai.Part{
+		genai.FunctionResponse{Name: "first", Response: map[string]any{"result": "first"}},
+		genai.FunctionResponse{Name: "second", Response: map[string]any{"error": "second failed"}},
+		genai.FunctionResponse{Name: "third", Response: map[string]any{"result": "third"}},
+	}
+	if !reflect.DeepEqual(chat.Sent[1], want) {
+		t.Errorf("function responses = %v, want %v", chat.Sent[1], want)
+	}
+	checkToolHistory(t, chat.History())
+}
+
+func TestSendMaxToolRounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []*Response
+		wantErr   bool
+		wantRan   int
+	}{
+		{
+			name:      "final answer after the limit",
+			responses: []*Response{callResponse("", "a"), callResponse("", "b"), textResponse("answer")},
+			wantRan:   1,
+		},
+		{
+			name:      "model keeps calling",
+			responses: []*Response{callResponse("", "a"), callResponse("", "b"), callResponse("", "c")},
+			wantErr:   true,
+			wantRan:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat := NewFakeProvider(tt.responses...).StartChat(ChatConfig{}).(*FakeChat)
+			ran := 0
+			engine := NewChatEngine(chat, func(ctx context.Context, call genai.FunctionCall) (map[string]any, error) {
+				ran++
+				return nil, nil
+			})
+			engine.MaxToolRounds = 1
+
+			_, err := engine.Send(context.Background(), nil, genai.Text("hi"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if ran != tt.wantRan {
+				t.Errorf("ran %d tools, want %d", ran, tt.wantRan)
+			}
+			// the call over the limit is answered without running it
+			response := chat.Sent[2][0].(genai.FunctionResponse)
+			if !strings.Contains(response.Response["error"].(string), "limit") {
+				t.Errorf("call over the limit answered with %v", response.Response)
+			}
+			checkToolHistory(t, chat.History())
+		})
+	}
+}
+
+func TestSendCancelledMidRound(t *testing.T) {
+	chat := NewFakeProvider(callResponse("", "first", "second"), textResponse("unused")).StartChat(ChatConfig{}).(*FakeChat)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var ran []string
+	engine := NewChatEngine(chat, func(ctx context.Context, call genai.FunctionCall) (map[string]any, error) {
+		ran = append(ran, call.Name)
+		cancel() // the user presses Stop while the first tool runs
+		return map[string]any{"ok": true}, nil
+	})
+
+	var events []Event
+	_, err := engine.Send(ctx, func(event Event) {
+		events = append(events, event)
+	}, genai.Text("hi"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if !reflect.DeepEqual(ran, []string{"first"}) {
+		t.Errorf("ran %v, want only first", ran)
+	}
+	// the second call is not shown as started
+	want := []EventType{EventUserMessage, EventToolCallStarted, EventToolCallFinished, EventError}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	history := chat.History()
+	checkToolHistory(t, history)
+	last := history[len(history)-1]
+	if last.Role != "model" || !strings.HasPrefix(messageText(last), "Stopped:") {
+		t.Errorf("last turn = %s %q, want the model saying it stopped", last.Role, messageText(last))
+	}
+	// the result of the call that ran is kept
+	responses := history[len(history)-2].Parts
+	if got := responses[0].(genai.FunctionResponse).Response; !reflect.DeepEqual(got, map[string]any{"ok": true}) {
+		t.Errorf("first call answered with %v", got)
+	}
+}
+
+func TestSendFollowUpFails(t *testing.T) {
+	// no response is scripted for the function responses, so sending them fails
+	chat := NewFakeProvider(callResponse("", "first")).StartChat(ChatConfig{}).(*FakeChat)
+	engine := NewChatEngine(chat, func(ctx context.Context, call genai.FunctionCall) (map[string]any, error) {
+		return nil, nil
+	})
+
+	if _, err := engine.Send(context.Background(), nil, genai.Text("hi")); err == nil {
+		t.Fatal("expected an error")
+	}
+	checkToolHistory(t, chat.History())
+}
+
+// eventTypes returns the types of events, runs of deltas are merged
+func eventTypes(events []Event) []EventType {
+	var types []EventType
+	for _, event := range events {
+		if event.Type == EventAssistantDelta && len(types) > 0 && types[len(types)-1] == EventAssistantDelta {
+			continue
+		}
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestSendEventOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []*Response
+		want      []EventType
+	}{
+		{
+			name:      "text only",
+			responses: []*Response{textResponse("hello there")},
+			want:      []EventType{EventUserMessage, EventAssistantDelta, EventDone},
+		},
+		{
+			name:      "tool calls",
+			responses: []*Response{callResponse("let me look", "a", "b"), textResponse("found it")},
+			want: []EventType{EventUserMessage, EventAssistantDelta,
+				EventToolCallStarted, EventToolCallFinished, EventToolCallStarted, EventToolCallFinished,
+				EventAssistantDelta, EventDone},
+		},
+		{
+			name:      "error",
+			responses: []*Response{callResponse("", "a")},
+			want:      []EventType{EventUserMessage, EventToolCallStarted, EventToolCallFinished, EventError},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat := NewFakeProvider(tt.responses...).StartChat(ChatConfig{})
+			engine := NewChatEngine(chat, func(ctx context.Context, call genai.FunctionCall) (map[string]any, error) {
+				return nil, nil
+			})
+			var events []Event
+			answer, _ := engine.Send(context.Background(), func(event Event) {
+				events = append(events, event)
+			}, genai.Text("hi"))
+
+			if got := eventTypes(events); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("events = %v, want %v", got, tt.want)
+			}
+			if events[0].Text != "hi" {
+				t.Errorf("user message event text = %q", events[0].Text)
+			}
+			last := events[len(events)-1]
+			if last.Type == EventDone && last.Text != answer {
+				t.Errorf("done event text = %q, answer %q", last.Text, answer)
+			}
+			if last.Type == EventError && last.Err == nil {
+				t.Error("error event without error")
+			}
+		})
+	}
+}
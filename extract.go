@@ -0,0 +1,678 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// ErrCodeUnsupportedFile is returned for files which can't be read as text
+const ErrCodeUnsupportedFile = "unsupported_file_type"
+
+const (
+	maxExtractSize = 50 << 20 // larger files are not read
+	maxXMLPartSize = 50 << 20 // uncompressed size limit of a part of a DOCX or XLSX file
+)
+
+// extractText returns the text of a file for the model. PDF, DOCX, XLSX and
+// HTML files are converted, other binary files are refused.
+func extractText(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > maxExtractSize {
+		return "", &ToolError{Code: ErrCodeUnsupportedFile, Message: fmt.Sprintf("%s is too large to read (%d MB)", filepath.Base(filePath), info.Size()>>20)}
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	mimeType, err := getFileMimeType(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	var text string
+	switch ext := strings.ToLower(filepath.Ext(filePath)); {
+	case ext == ".pdf" || mimeType == "application/pdf":
+		text, err = pdfText(data)
+	case ext == ".docx":
+		text, err = docxText(data)
+	case ext == ".xlsx":
+		text, err = xlsxText(data)
+	case ext == ".html" || ext == ".htm" || strings.HasPrefix(mimeType, "text/html"):
+		text, err = htmlText(data)
+	case !isBinary(data):
+		// plain text, csv, source code
+		text = strings.ToValidUTF8(string(data), "�")
+	default:
+		return "", &ToolError{Code: ErrCodeUnsupportedFile, Message: fmt.Sprintf("%s is a binary file (%s) and can't be read as text", filepath.Base(filePath), mimeType)}
+	}
+	if err != nil {
+		return "", &ToolError{Code: ErrCodeUnsupportedFile, Message: fmt.Sprintf("could not read %s: %v", filepath.Base(filePath), err)}
+	}
+	return text, nil
+}
+
+// textPage returns limit lines of text starting after offset lines, cut to
+// at most maxChars characters. next is the offset of the following page,
+// or 0 if the text ends.
+func textPage(text string, offset int, limit int, maxChars int) (page string, next int, total int) {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	total = len(lines)
+	offset = min(max(offset, 0), total)
+	end := min(offset+limit, total)
+
+	var sb strings.Builder
+	for i := offset; i < end; i++ {
+		if sb.Len()+len(lines[i]) > maxChars && i > offset {
+			end = i
+			break
+		}
+		sb.WriteString(lines[i])
+	}
+	page = sb.String()
+	if len(page) > maxChars {
+		// a single very long line
+		page = strings.ToValidUTF8(page[:maxChars], "")
+	}
+	if end < total {
+		next = end
+	}
+	return page, next, total
+}
+
+// docxText returns the paragraphs of a Word document
+func docxText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	doc, err := zipPart(zr, "word/document.xml")
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				sb.WriteString("\t")
+			case "br", "cr":
+				sb.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				sb.WriteString("\n")
+			case "tc":
+				sb.WriteString("\t")
+			}
+		case xml.CharData:
+			if inText {
+				sb.Write(t)
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+// xlsxText returns the sheets of an Excel workbook as tab separated rows
+func xlsxText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var sharedStrings []string
+	if part, err := zipPart(zr, "xl/sharedStrings.xml"); err == nil {
+		var sst struct {
+			Items []struct {
+				Text string `xml:"t"`
+				Runs []struct {
+					Text string `xml:"t"`
+				} `xml:"r"`
+			} `xml:"si"`
+		}
+		if err := xml.Unmarshal(part, &sst); err != nil {
+			return "", err
+		}
+		for _, item := range sst.Items {
+			text := item.Text
+			for _, run := range item.Runs {
+				text += run.Text
+			}
+			sharedStrings = append(sharedStrings, text)
+		}
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	part, err := zipPart(zr, "xl/workbook.xml")
+	if err != nil {
+		return "", err
+	}
+	if err := xml.Unmarshal(part, &workbook); err != nil {
+		return "", err
+	}
+	part, err = zipPart(zr, "xl/_rels/workbook.xml.rels")
+	if err != nil {
+		return "", err
+	}
+	if err := xml.Unmarshal(part, &rels); err != nil {
+		return "", err
+	}
+	targets := map[string]string{}
+	for _, rel := range rels.Relationships {
+		target := strings.TrimPrefix(rel.Target, "/")
+		if !strings.HasPrefix(target, "xl/") {
+			target = path.Join("xl", target)
+		}
+		targets[rel.ID] = target
+	}
+
+	var sb strings.Builder
+	for _, sheet := range workbook.Sheets {
+		part, err := zipPart(zr, targets[sheet.ID])
+		if err != nil {
+			return "", err
+		}
+		var worksheet struct {
+			Rows []struct {
+				Cells []struct {
+					Ref    string `xml:"r,attr"`
+					Type   string `xml:"t,attr"`
+					Value  string `xml:"v"`
+					Inline string `xml:"is>t"`
+				} `xml:"c"`
+			} `xml:"sheetData>row"`
+		}
+		if err := xml.Unmarshal(part, &worksheet); err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(&sb, "# Sheet: %s\n", sheet.Name)
+		for _, row := range worksheet.Rows {
+			var cells []string
+			for _, cell := range row.Cells {
+				value := cell.Value
+				switch cell.Type {
+				case "s":
+					if i, err := strconv.Atoi(value); err == nil && i < len(sharedStrings) {
+						value = sharedStrings[i]
+					}
+				case "inlineStr":
+					value = cell.Inline
+				case "b":
+					value = strconv.FormatBool(value == "1")
+				}
+				// keep the column of the cell, empty cells are left out of the file
+				for col := cellColumn(cell.Ref); len(cells) < col; {
+					cells = append(cells, "")
+				}
+				cells = append(cells, strings.ReplaceAll(value, "\n", " "))
+			}
+			sb.WriteString(strings.Join(cells, "\t") + "\n")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// cellColumn returns the 0 based column of a cell reference like "AB12"
+func cellColumn(ref string) int {
+	col := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		col = col*26 + int(c-'A'+1)
+	}
+	return max(col-1, 0)
+}
+
+// zipPart reads a file of a zip archive
+func zipPart(zr *zip.Reader, name string) ([]byte, error) {
+	file, err := zr.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxXMLPartSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxXMLPartSize {
+		return nil, fmt.Errorf("%s is too large", name)
+	}
+	return data, nil
+}
+
+// htmlText returns the visible text of an HTML page
+func htmlText(data []byte) (string, error) {
+	var sb strings.Builder
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	skip := 0 // depth inside script, style and similar elements
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if tokenizer.Err() == io.EOF {
+				return strings.TrimSpace(blankLines.ReplaceAllString(sb.String(), "\n\n")), nil
+			}
+			return "", tokenizer.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "noscript", "template", "svg":
+				skip++
+			case "br", "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "section", "article", "header", "footer":
+				sb.WriteString("\n")
+			case "td", "th":
+				sb.WriteString("\t")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "noscript", "template", "svg":
+				skip = max(skip-1, 0)
+			case "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "table", "ul", "ol":
+				sb.WriteString("\n")
+			}
+		case html.TextToken:
+			if skip == 0 {
+				text := strings.Join(strings.Fields(string(tokenizer.Text())), " ")
+				if text != "" {
+					sb.WriteString(text + " ")
+				}
+			}
+		}
+	}
+}
+
+var blankLines = regexp.MustCompile(`[ \t]*\n\s*\n\s*`)
+
+var (
+	pdfStream     = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+	pdfBFChar     = regexp.MustCompile(`<([0-9A-Fa-f]+)>\s*<([0-9A-Fa-f]+)>`)
+	pdfBFRange    = regexp.MustCompile(`<([0-9A-Fa-f]+)>\s*<([0-9A-Fa-f]+)>\s*<([0-9A-Fa-f]+)>`)
+	pdfBlock      = regexp.MustCompile(`(?s)begin(bfchar|bfrange)(.*?)end(bfchar|bfrange)`)
+	pdfTextObject = regexp.MustCompile(`(?s)\bBT\b(.*?)\bET\b`)
+	pdfObject     = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	pdfRef        = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s*(\d+)\s+\d+\s+R\b`)
+	pdfFonts      = regexp.MustCompile(`(?s)/Font\s*(?:<<(.*?)>>|(\d+)\s+\d+\s+R\b)`)
+	pdfToUnicode  = regexp.MustCompile(`/ToUnicode\s*(\d+)\s+\d+\s+R\b`)
+	pdfSetFont    = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+[-+\d.]+\s+Tf\b`)
+)
+
+// pdfFont tells how the strings shown with a font are decoded
+type pdfFont struct {
+	cmap      map[int]string // the ToUnicode map, nil for standard fonts
+	codeBytes int            // bytes per character code
+}
+
+// pdfText extracts the text of a PDF. This is a best effort reader: it
+// inflates the content streams and decodes their text operators, using the
+// ToUnicode maps of the fonts when there are any. Scanned pages have no text.
+func pdfText(data []byte) (string, error) {
+	if !bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) {
+		return "", fmt.Errorf("not a PDF file")
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return "", fmt.Errorf("the PDF is encrypted")
+	}
+
+	// objects by number, their bodies end where the next object starts
+	objects := map[int][]byte{}
+	objectLocs := pdfObject.FindAllSubmatchIndex(data, -1)
+	for i, loc := range objectLocs {
+		end := len(data)
+		if i+1 < len(objectLocs) {
+			end = objectLocs[i+1][0]
+		}
+		n, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		objects[n] = data[loc[1]:end]
+	}
+	// objectAt returns the number of the object at offset, -1 if there is none
+	objectAt := func(offset int) int {
+		i := sort.Search(len(objectLocs), func(i int) bool { return objectLocs[i][0] > offset }) - 1
+		if i < 0 {
+			return -1
+		}
+		n, _ := strconv.Atoi(string(data[objectLocs[i][2]:objectLocs[i][3]]))
+		return n
+	}
+
+	var streams [][]byte
+	objectStreams := map[int][]byte{}
+	damaged := false // a stream is cut off or can't be inflated
+	for _, loc := range pdfStream.FindAllSubmatchIndex(data, -1) {
+		dict := data[loc[2]:loc[3]]
+		// the match may start in an earlier object
+		if i := bytes.LastIndex(dict, []byte("obj")); i >= 0 {
+			dict = dict[i+len("obj"):]
+		}
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			damaged = true
+			continue
+		}
+		content := data[start : start+end]
+		if bytes.Contains(dict, []byte("/Subtype/Image")) || bytes.Contains(dict, []byte("/Subtype /Image")) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			r, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				damaged = true
+				continue
+			}
+			// streams without a valid end still return the data read so far
+			content, _ = io.ReadAll(io.LimitReader(r, maxExtractSize))
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			// other filters are used for images and fonts
+			continue
+		}
+		streams = append(streams, content)
+		objectStreams[objectAt(start)] = content
+	}
+
+	// fonts by resource name. Pages may give the same name to different
+	// fonts, the first one is used.
+	fonts := map[string]pdfFont{}
+	for _, m := range pdfFonts.FindAllSubmatch(data, -1) {
+		resources := m[1]
+		if m[2] != nil {
+			n, _ := strconv.Atoi(string(m[2]))
+			resources = objects[n]
+		}
+		for _, ref := range pdfRef.FindAllSubmatch(resources, -1) {
+			name := string(ref[1])
+			if _, ok := fonts[name]; ok {
+				continue
+			}
+			n, _ := strconv.Atoi(string(ref[2]))
+			font := pdfFont{codeBytes: 1}
+			if to := pdfToUnicode.FindSubmatch(objects[n]); to != nil {
+				cmapObject, _ := strconv.Atoi(string(to[1]))
+				if cmap, codeBytes := pdfCMap(objectStreams[cmapObject]); len(cmap) > 0 {
+					font = pdfFont{cmap: cmap, codeBytes: codeBytes}
+				}
+			}
+			fonts[name] = font
+		}
+	}
+
+	// without font resources the ToUnicode maps of all streams are merged,
+	// which is right for the common case of one embedded font family
+	fallback := pdfFont{cmap: map[int]string{}, codeBytes: 1}
+	if len(fonts) == 0 {
+		for _, stream := range streams {
+			cmap, codeBytes := pdfCMap(stream)
+			for code, text := range cmap {
+				fallback.cmap[code] = text
+			}
+			fallback.codeBytes = max(fallback.codeBytes, codeBytes)
+		}
+	}
+
+	var sb strings.Builder
+	for _, stream := range streams {
+		font := fallback
+		last := 0
+		for _, loc := range pdfTextObject.FindAllSubmatchIndex(stream, -1) {
+			// the font may also be set between text objects
+			for _, m := range pdfSetFont.FindAllSubmatch(stream[last:loc[0]], -1) {
+				if f, ok := fonts[string(m[1])]; ok {
+					font = f
+				}
+			}
+			font = pdfTextOperators(&sb, stream[loc[2]:loc[3]], fonts, font)
+			sb.WriteString("\n")
+			last = loc[1]
+		}
+	}
+	text := strings.TrimSpace(blankLines.ReplaceAllString(sb.String(), "\n\n"))
+	if text == "" && damaged {
+		return "", fmt.Errorf("no text found, the PDF is damaged or truncated")
+	}
+	if text == "" {
+		return "", fmt.Errorf("no text found, the PDF may only contain scanned images")
+	}
+	return text, nil
+}
+
+// pdfCMap returns the mappings of a ToUnicode map and the bytes of its codes
+func pdfCMap(stream []byte) (map[int]string, int) {
+	cmap := map[int]string{}
+	codeBytes := 1
+	for _, block := range pdfBlock.FindAllSubmatch(stream, -1) {
+		if string(block[1]) == "bfchar" {
+			for _, m := range pdfBFChar.FindAllSubmatch(block[2], -1) {
+				code, _ := strconv.ParseInt(string(m[1]), 16, 32)
+				cmap[int(code)] = utf16Hex(m[2])
+				codeBytes = max(codeBytes, len(m[1])/2)
+			}
+			continue
+		}
+		for _, m := range pdfBFRange.FindAllSubmatch(block[2], -1) {
+			lo, _ := strconv.ParseInt(string(m[1]), 16, 32)
+			hi, _ := strconv.ParseInt(string(m[2]), 16, 32)
+			dst := []rune(utf16Hex(m[3]))
+			if len(dst) == 0 || hi-lo > 0xFFFF {
+				continue
+			}
+			for code := lo; code <= hi; code++ {
+				cmap[int(code)] = string(dst[:len(dst)-1]) + string(dst[len(dst)-1]+rune(code-lo))
+			}
+			codeBytes = max(codeBytes, len(m[1])/2)
+		}
+	}
+	return cmap, codeBytes
+}
+
+// pdfTextOperators writes the strings shown by the operators of a text
+// object, decoded with the fonts its Tf operators select. It returns the
+// font selected at the end.
+func pdfTextOperators(sb *strings.Builder, ops []byte, fonts map[string]pdfFont, font pdfFont) pdfFont {
+	name := "" // the last name operand, the font of Tf
+	for i := 0; i < len(ops); i++ {
+		switch c := ops[i]; {
+		case c == '(':
+			raw, end := pdfLiteral(ops, i)
+			sb.WriteString(pdfDecode(raw, font))
+			i = end
+		case c == '/':
+			end := i + 1
+			for end < len(ops) && !bytes.ContainsAny(ops[end:end+1], " \t\r\n/<>[]()") {
+				end++
+			}
+			name = string(ops[i+1 : end])
+			i = end - 1
+		case c == 'T' && i+1 < len(ops) && ops[i+1] == 'f':
+			if f, ok := fonts[name]; ok {
+				font = f
+			}
+			i++
+		case c == '<' && i+1 < len(ops) && ops[i+1] == '<':
+			// dictionary of marked content
+			i++
+		case c == '<':
+			end := bytes.IndexByte(ops[i:], '>')
+			if end < 0 {
+				return font
+			}
+			hex := bytes.Map(func(r rune) rune {
+				if strings.ContainsRune("0123456789abcdefABCDEF", r) {
+					return r
+				}
+				return -1
+			}, ops[i+1:i+end])
+			if len(hex)%2 == 1 {
+				hex = append(hex, '0')
+			}
+			raw := make([]byte, len(hex)/2)
+			for j := range raw {
+				b, _ := strconv.ParseUint(string(hex[2*j:2*j+2]), 16, 8)
+				raw[j] = byte(b)
+			}
+			sb.WriteString(pdfDecode(raw, font))
+			i += end
+		case c == 'T' && i+1 < len(ops) && (ops[i+1] == '*' || ops[i+1] == 'd' || ops[i+1] == 'D'):
+			sb.WriteString("\n")
+			i++
+		case c == '\'' || c == '"':
+			sb.WriteString("\n")
+		case c == '-' && i+1 < len(ops) && ops[i+1] >= '0' && ops[i+1] <= '9':
+			// a large negative kerning inside TJ arrays is a word gap
+			end := i + 1
+			for end < len(ops) && (ops[end] >= '0' && ops[end] <= '9' || ops[end] == '.') {
+				end++
+			}
+			if n, err := strconv.ParseFloat(string(ops[i+1:end]), 64); err == nil && n > 200 {
+				sb.WriteString(" ")
+			}
+			i = end - 1
+		}
+	}
+	return font
+}
+
+// pdfLiteral returns the bytes of the (string) starting at ops[start] and
+// the index of its closing parenthesis
+func pdfLiteral(ops []byte, start int) ([]byte, int) {
+	var raw []byte
+	depth := 0
+	for i := start; i < len(ops); i++ {
+		c := ops[i]
+		switch {
+		case c == '\\' && i+1 < len(ops):
+			i++
+			switch e := ops[i]; e {
+			case 'n':
+				raw = append(raw, '\n')
+			case 'r':
+				raw = append(raw, '\r')
+			case 't':
+				raw = append(raw, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					end := i
+					for end < len(ops) && end < i+3 && ops[end] >= '0' && ops[end] <= '7' {
+						end++
+					}
+					n, _ := strconv.ParseUint(string(ops[i:end]), 8, 8)
+					raw = append(raw, byte(n))
+					i = end - 1
+				} else {
+					raw = append(raw, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				raw = append(raw, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return raw, i
+			}
+			raw = append(raw, c)
+		default:
+			raw = append(raw, c)
+		}
+	}
+	return raw, len(ops)
+}
+
+// pdfDecode converts the bytes of a PDF string to text
+func pdfDecode(raw []byte, font pdfFont) string {
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		return utf16BE(raw[2:])
+	}
+	cmap, codeBytes := font.cmap, font.codeBytes
+	if len(cmap) == 0 {
+		// standard fonts use (close to) Latin-1
+		runes := make([]rune, len(raw))
+		for i, b := range raw {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	var sb strings.Builder
+	for i := 0; i+codeBytes <= len(raw); i += codeBytes {
+		code := 0
+		for _, b := range raw[i : i+codeBytes] {
+			code = code<<8 | int(b)
+		}
+		if text, ok := cmap[code]; ok {
+			sb.WriteString(text)
+		} else if codeBytes == 1 {
+			sb.WriteRune(rune(code))
+		}
+	}
+	return sb.String()
+}
+
+// utf16Hex decodes the UTF-16BE hex digits of a ToUnicode map
+func utf16Hex(hex []byte) string {
+	raw := make([]byte, len(hex)/2)
+	for i := range raw {
+		b, _ := strconv.ParseUint(string(hex[2*i:2*i+2]), 16, 8)
+		raw[i] = byte(b)
+	}
+	return utf16BE(raw)
+}
+
+func utf16BE(raw []byte) string {
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = uint16(raw[2*i])<<8 | uint16(raw[2*i+1])
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractText(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"plain.pdf", "Hello from a PDF\nKerned words\nEscaped (parens) and café"},
+		// FlateDecode content with a ToUnicode map of 2 byte codes
+		{"compressed.pdf", "Compressed text\nABC"},
+		// a simple font and a font with 2 byte codes, also set outside of BT
+		{"mixed.pdf", "Simple font\n\nЖЯ and back\n\nЯ"},
+		{"sample.docx", "First paragraph\nSplit runs\ttabbed\nbroken\ncell 1\n\tcell 2\n\t"},
+		{"sample.xlsx", "# Sheet: Prices\nItem\tPrice\nRich text\t\t4.5\nInline\ttrue\n\n# Sheet: Notes\n\tsecond sheet\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := extractText(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractTextErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	docx, err := os.ReadFile(filepath.Join("testdata", "sample.docx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"truncated PDF", filepath.Join("testdata", "truncated.pdf"), "damaged or truncated"},
+		{"not a PDF", write("fake.pdf", []byte("just some text")), "not a PDF file"},
+		{"encrypted PDF", write("encrypted.pdf", []byte("%PDF-1.4\ntrailer << /Encrypt 5 0 R >>\n")), "encrypted"},
+		{"PDF without text", write("scan.pdf", []byte("%PDF-1.4\n1 0 obj << >> endobj\n")), "scanned images"},
+		{"truncated DOCX", write("cut.docx", docx[:len(docx)/2]), "could not read cut.docx"},
+		{"XLSX without workbook", write("empty.xlsx", docx), "xl/workbook.xml"},
+		{"binary", write("data.bin", []byte{0x7f, 'E', 'L', 'F', 0, 0, 0, 1, 2, 3}), "binary file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := extractText(tt.path)
+			var toolErr *ToolError
+			if !errors.As(err, &toolErr) || toolErr.Code != ErrCodeUnsupportedFile {
+				t.Fatalf("err = %v, want %s", err, ErrCodeUnsupportedFile)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextPage(t *testing.T) {
+	text := "one\ntwo\nthree\nfour\n"
+	tests := []struct {
+		name     string
+		text     string
+		offset   int
+		limit    int
+		maxChars int
+		want     string
+		next     int
+		total    int
+	}{
+		{"all", text, 0, 10, 100, text, 0, 4},
+		{"first page", text, 0, 2, 100, "one\ntwo\n", 2, 4},
+		{"last page", text, 2, 2, 100, "three\nfour\n", 0, 4},
+		{"offset past the end", text, 9, 2, 100, "", 0, 4},
+		{"negative offset", text, -3, 1, 100, "one\n", 1, 4},
+		{"cut at maxChars", text, 0, 10, 9, "one\ntwo\n", 2, 4},
+		{"single long line", "abcdefghij\nk\n", 0, 10, 4, "abcd", 1, 2},
+		{"no trailing newline", "a\nb", 0, 10, 100, "a\nb", 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, next, total := textPage(tt.text, tt.offset, tt.limit, tt.maxChars)
+			if page != tt.want || next != tt.next || total != tt.total {
+				t.Errorf("textPage = %q, %d, %d, want %q, %d, %d", page, next, total, tt.want, tt.next, tt.total)
+			}
+		})
+	}
+}
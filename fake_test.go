@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/google/generative-ai-go/genai"
+	"strings"
+)
+
+// FakeProvider is an offline provider which replays scripted responses, so the
+// chat engine and its tool call loop can be exercised without network access.
+// Without a script it echoes the user's text back.
+type FakeProvider struct {
+	responses []*Response
+}
+
+func NewFakeProvider(responses ...*Response) *FakeProvider {
+	return &FakeProvider{responses: responses}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) StartChat(cfg ChatConfig) ChatSession {
+	return &FakeChat{SystemPrompt: cfg.SystemPrompt, responses: append([]*Response{}, p.responses...), echo: len(p.responses) == 0}
+}
+
+func (p *FakeProvider) Close() error {
+	return nil
+}
+
+// FakeChat is the session of a FakeProvider. Sent records the parts of every
+// message so callers can check what the engine sent back to the model.
+type FakeChat struct {
+	Sent         [][]genai.Part
+	SystemPrompt string
+	responses    []*Response
+	echo         bool
+	history      []*genai.Content
+}
+
+func (c *FakeChat) SendMessage(ctx context.Context, parts ...genai.Part) (*Response, error) {
+	return c.SendMessageStream(ctx, nil, parts...)
+}
+
+// SendMessageStream streams the text of the next scripted response word by word
+func (c *FakeChat) SendMessageStream(ctx context.Context, onText func(text string), parts ...genai.Part) (*Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.Sent = append(c.Sent, parts)
+
+	var res *Response
+	switch {
+	case c.echo:
+		res = &Response{Parts: []genai.Part{genai.Text((&Response{Parts: parts}).Text())}}
+	case len(c.responses) == 0:
+		return nil, errors.New("fake provider: no scripted response left")
+	default:
+		res = c.responses[0]
+		c.responses = c.responses[1:]
+	}
+
+	if onText != nil {
+		for _, part := range res.Parts {
+			text, ok := part.(genai.Text)
+			if !ok {
+				continue
+			}
+			for _, word := range strings.SplitAfter(string(text), " ") {
+				onText(word)
+			}
+		}
+	}
+
+	c.history = append(c.history, genai.NewUserContent(parts...), &genai.Content{Role: "model", Parts: res.Parts})
+	return res, nil
+}
+
+func (c *FakeChat) History() []*genai.Content {
+	return c.history
+}
+
+func (c *FakeChat) SetHistory(history []*genai.Content) {
+	c.history = history
+}
+
+func (c *FakeChat) SetSystemPrompt(prompt string) {
+	c.SystemPrompt = prompt
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"log"
+	"strings"
+)
+
+// Attachment describes a file sent with a message. Only the metadata is
+// persisted, reopened conversations get a placeholder instead of the data
+// (uploaded files are referenced until they expire).
+type Attachment struct {
+	Name     string `json:"name"`
+	MIMEType string `json:"mime_type"`
+	Size     int    `json:"size"`
+}
+
+// storedPart is the JSON form of a genai.Part in Message.Parts
+type storedPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Attachment       *Attachment             `json:"attachment,omitempty"`
+	FileURI          string                  `json:"file_uri,omitempty"`
+	FunctionCall     *genai.FunctionCall     `json:"function_call,omitempty"`
+	FunctionResponse *genai.FunctionResponse `json:"function_response,omitempty"`
+}
+
+// recordingChat persists every turn of the wrapped session to the database
+type recordingChat struct {
+	ChatSession
+	conversation *Conversation
+	attachments  []Attachment // of the last parts of the next user message, one each
+}
+
+func newRecordingChat(cs ChatSession, conversation *Conversation) *recordingChat {
+	return &recordingChat{ChatSession: cs, conversation: conversation}
+}
+
+// Attach sets the attachment metadata stored with the next user message,
+// whose last parts are the attachments in the same order
+func (r *recordingChat) Attach(attachments ...Attachment) {
+	r.attachments = attachments
+}
+
+// conversationKey is the context key of the conversation tools run in
+type conversationKey struct{}
+
+// toolContext returns ctx telling tools which conversation they run in. The
+// first turn is saved before its tool calls run, so the ID is known by then.
+func (r *recordingChat) toolContext(ctx context.Context) context.Context {
+	if r.conversation == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, conversationKey{}, r.conversation.ID)
+}
+
+// conversationID returns the ID of the conversation a tool runs in
+func conversationID(ctx context.Context) (uint, bool) {
+	id, ok := ctx.Value(conversationKey{}).(uint)
+	return id, ok
+}
+
+// Reset starts a new conversation
+func (r *recordingChat) Reset() {
+	r.SetHistory(nil)
+	r.conversation = nil
+	r.attachments = nil
+}
+
+func (r *recordingChat) SendMessage(ctx context.Context, parts ...genai.Part) (*Response, error) {
+	before := len(r.History())
+	res, err := r.ChatSession.SendMessage(ctx, parts...)
+	if err != nil {
+		return nil, err
+	}
+	r.record(before, res.Usage)
+	return res, nil
+}
+
+func (r *recordingChat) SendMessageStream(ctx context.Context, onText func(text string), parts ...genai.Part) (*Response, error) {
+	before := len(r.History())
+	res, err := r.ChatSession.SendMessageStream(ctx, onText, parts...)
+	if err != nil {
+		return nil, err
+	}
+	r.record(before, res.Usage)
+	return res, nil
+}
+
+// AppendHistory adds contents to the history and saves them
+func (r *recordingChat) AppendHistory(contents ...*genai.Content) {
+	before := len(r.History())
+	r.SetHistory(append(r.History(), contents...))
+	r.record(before, Usage{})
+}
+
+// record saves the history entries added since before. Failures are only
+// logged, losing a turn is better than breaking the chat.
+func (r *recordingChat) record(before int, usage Usage) {
+	history := r.History()
+	if before > len(history) {
+		return
+	}
+
+	var messages []Message
+	for _, content := range history[before:] {
+		var attachments []Attachment
+		if content.Role != "model" {
+			attachments = r.attachments
+			r.attachments = nil
+		}
+		parts, meta, err := encodeParts(content.Parts, attachments)
+		if err != nil {
+			log.Println("Error encoding message:", err)
+			return
+		}
+		msg := Message{Role: content.Role, Parts: parts, Attachments: meta}
+		if content.Role == "model" {
+			msg.PromptTokens = usage.PromptTokens
+			msg.OutputTokens = usage.OutputTokens
+		}
+		messages = append(messages, msg)
+	}
+
+	if r.conversation == nil {
+		conversation, err := CreateConversation(db, conversationTitle(history))
+		if err != nil {
+			log.Println("Error creating conversation:", err)
+			return
+		}
+		r.conversation = conversation
+	}
+	if err := InsertMessages(db, r.conversation.ID, messages); err != nil {
+		log.Println("Error saving messages:", err)
+	}
+}
+
+// conversationTitle returns the start of the first user text
+func conversationTitle(history []*genai.Content) string {
+	for _, content := range history {
+		for _, part := range content.Parts {
+			if text, ok := part.(genai.Text); ok && strings.TrimSpace(string(text)) != "" {
+				title := strings.Join(strings.Fields(string(text)), " ")
+				if len(title) > 40 {
+					title = strings.ToValidUTF8(title[:40], "") + "..."
+				}
+				return title
+			}
+		}
+	}
+	return "New conversation"
+}
+
+// encodeParts returns the JSON parts and attachment metadata of a message.
+// attachments describe the last parts, text ones too. Blob data is replaced
+// by its metadata.
+func encodeParts(parts []genai.Part, attachments []Attachment) (string, string, error) {
+	first := len(parts) - len(attachments)
+	if first < 0 {
+		log.Printf("Not saving %d attachment names for %d message parts", len(attachments), len(parts))
+		attachments, first = nil, len(parts)
+	}
+	var stored []storedPart
+	for i, part := range parts {
+		var attachment *Attachment
+		if i >= first {
+			attachment = &attachments[i-first]
+		}
+		switch p := part.(type) {
+		case genai.Text:
+			stored = append(stored, storedPart{Text: string(p)})
+		case genai.Blob:
+			if attachment == nil {
+				attachment = &Attachment{MIMEType: p.MIMEType, Size: len(p.Data)}
+			}
+			stored = append(stored, storedPart{Attachment: attachment})
+		case genai.FileData:
+			if attachment == nil {
+				attachment = &Attachment{MIMEType: p.MIMEType}
+			}
+			stored = append(stored, storedPart{Attachment: attachment, FileURI: p.URI})
+		case genai.FunctionCall:
+			stored = append(stored, storedPart{FunctionCall: &p})
+		case genai.FunctionResponse:
+			stored = append(stored, storedPart{FunctionResponse: &p})
+		default:
+			return "", "", fmt.Errorf("unsupported message part %T", part)
+		}
+	}
+
+	partsJSON, err := json.Marshal(stored)
+	if err != nil {
+		return "", "", err
+	}
+	if len(attachments) == 0 {
+		return string(partsJSON), "", nil
+	}
+	metaJSON, err := json.Marshal(attachments)
+	if err != nil {
+		return "", "", err
+	}
+	return string(partsJSON), string(metaJSON), nil
+}
+
+// decodeParts is the reverse of encodeParts, attachments become text
+// placeholders unless they were uploaded and account can still use them,
+// see availableUpload
+func decodeParts(data string, account string) ([]genai.Part, error) {
+	var stored []storedPart
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return nil, err
+	}
+	var parts []genai.Part
+	for _, p := range stored {
+		switch {
+		case p.FunctionCall != nil:
+			parts = append(parts, *p.FunctionCall)
+		case p.FunctionResponse != nil:
+			parts = append(parts, *p.FunctionResponse)
+		case p.FileURI != "":
+			if file, ok := availableUpload(p.FileURI, account); ok {
+				parts = append(parts, file)
+			} else {
+				parts = append(parts, unavailableAttachment(p.Attachment))
+			}
+		case p.Attachment != nil:
+			parts = append(parts, unavailableAttachment(p.Attachment))
+		default:
+			parts = append(parts, genai.Text(p.Text))
+		}
+	}
+	return parts, nil
+}
+
+// unavailableAttachment is the placeholder of an attachment whose data is gone
+func unavailableAttachment(attachment *Attachment) genai.Text {
+	if attachment == nil {
+		return genai.Text("[attachment is no longer available]")
+	}
+	if attachment.Name == "" {
+		return genai.Text(fmt.Sprintf("[attachment (%s) is no longer available]", attachment.MIMEType))
+	}
+	return genai.Text(fmt.Sprintf("[attachment %q (%s) is no longer available]", attachment.Name, attachment.MIMEType))
+}
+
+// loadConversation returns the chat history and stored messages of a
+// conversation, for a provider whose uploads belong to account
+func loadConversation(conversationID uint, account string) ([]*genai.Content, []Message, error) {
+	messages, err := GetMessages(db, conversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var history []*genai.Content
+	for _, msg := range messages {
+		parts, err := decodeParts(msg.Parts, account)
+		if err != nil {
+			return nil, nil, fmt.Errorf("message %d: %v", msg.ID, err)
+		}
+		history = append(history, &genai.Content{Role: msg.Role, Parts: parts})
+	}
+	return history, messages, nil
+}
+
+// messageText returns the text of a history entry shown in a chat card
+func messageText(content *genai.Content) string {
+	var texts []string
+	for _, part := range content.Parts {
+		if text, ok := part.(genai.Text); ok && string(text) != "" {
+			texts = append(texts, string(text))
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
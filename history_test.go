@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/google/generative-ai-go/genai"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodePartsUploads(t *testing.T) {
+	useTestDB(t)
+	valid := time.Now().Add(24 * time.Hour)
+	for _, upload := range []UploadedFile{
+		{Hash: "video", Account: "old", URI: "uri/old-video", MIMEType: "video/mp4", ExpiresAt: valid},
+		{Hash: "video", Account: "new", URI: "uri/new-video", MIMEType: "video/mp4", ExpiresAt: valid},
+		{Hash: "pdf", Account: "old", URI: "uri/old-pdf", MIMEType: "application/pdf", ExpiresAt: valid},
+		{Hash: "audio", Account: "new", URI: "uri/expired", MIMEType: "audio/mp3", ExpiresAt: time.Now()},
+	} {
+		if err := SaveUploadedFile(db, &upload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parts := []genai.Part{
+		genai.Text("look at these"),
+		genai.FileData{MIMEType: "video/mp4", URI: "uri/old-video"},
+		genai.FileData{MIMEType: "application/pdf", URI: "uri/old-pdf"},
+		genai.FileData{MIMEType: "audio/mp3", URI: "uri/expired"},
+	}
+	attachments := []Attachment{{Name: "a.mp4", MIMEType: "video/mp4"}, {Name: "b.pdf", MIMEType: "application/pdf"}, {Name: "c.mp3", MIMEType: "audio/mp3"}}
+	data, _, err := encodeParts(parts, attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		account string
+		want    []genai.Part
+	}{
+		{"old", []genai.Part{
+			genai.Text("look at these"),
+			genai.FileData{MIMEType: "video/mp4", URI: "uri/old-video"},
+			genai.FileData{MIMEType: "application/pdf", URI: "uri/old-pdf"},
+			genai.Text(`[attachment "c.mp3" (audio/mp3) is no longer available]`),
+		}},
+		// another key uses its own upload of the same content
+		{"new", []genai.Part{
+			genai.Text("look at these"),
+			genai.FileData{MIMEType: "video/mp4", URI: "uri/new-video"},
+			genai.Text(`[attachment "b.pdf" (application/pdf) is no longer available]`),
+			genai.Text(`[attachment "c.mp3" (audio/mp3) is no longer available]`),
+		}},
+		// providers which can't upload get no uploads
+		{"", []genai.Part{
+			genai.Text("look at these"),
+			genai.Text(`[attachment "a.mp4" (video/mp4) is no longer available]`),
+			genai.Text(`[attachment "b.pdf" (application/pdf) is no longer available]`),
+			genai.Text(`[attachment "c.mp3" (audio/mp3) is no longer available]`),
+		}},
+	}
+	for _, tt := range tests {
+		got, err := decodeParts(data, tt.account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("account %q: got %v, want %v", tt.account, got, tt.want)
+		}
+	}
+
+	history := []*genai.Content{{Role: "user", Parts: parts}}
+	got := useUploads(history, "new")
+	if want := (genai.FileData{MIMEType: "video/mp4", URI: "uri/new-video"}); got[0].Parts[1] != want {
+		t.Errorf("useUploads: %v, want %v", got[0].Parts[1], want)
+	}
+	if history[0].Parts[1] != parts[1] {
+		t.Error("useUploads changed the history passed in")
+	}
+}
+
+func TestEncodePartsAttachments(t *testing.T) {
+	parts := []genai.Part{
+		genai.Text("compare these"),
+		genai.Text("--- file: notes.txt ---\nhello\n--- end of notes.txt ---"),
+		genai.Blob{MIMEType: "image/png", Data: []byte("png data")},
+		genai.FileData{MIMEType: "video/mp4", URI: "uri/video"},
+	}
+	attachments := []Attachment{
+		{Name: "notes.txt", MIMEType: "text/plain", Size: 6},
+		{Name: "photo.png", MIMEType: "image/png", Size: 8},
+		{Name: "clip.mp4", MIMEType: "video/mp4", Size: 5 << 20},
+	}
+	data, meta, err := encodeParts(parts, attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored []Attachment
+	if err := json.Unmarshal([]byte(meta), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored, attachments) {
+		t.Errorf("attachments = %v, want %v", stored, attachments)
+	}
+	got, err := decodeParts(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []genai.Part{
+		parts[0],
+		parts[1],
+		genai.Text(`[attachment "photo.png" (image/png) is no longer available]`),
+		genai.Text(`[attachment "clip.mp4" (video/mp4) is no longer available]`),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %v, want %v", got, want)
+	}
+}
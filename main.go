@@ -2,11 +2,10 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/google/generative-ai-go/genai"
-	"github.com/googleapis/gax-go/v2/apierror"
-	"gorm.io/gorm"
+	"image/color"
+	"io"
 	"log"
 	"mime"
 	"net/http"
@@ -14,9 +13,12 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
@@ -29,83 +31,108 @@ const DEVFLAG = false                     // will also save the captured image t
 const GenaiModel = "gemini-1.5-flash-002" // model to use
 
 type App struct {
-	client             *genai.Client
-	model              *genai.GenerativeModel
-	cs                 *genai.ChatSession
+	provider           Provider
+	cs                 *recordingChat
+	engine             *ChatEngine
 	captureImageChoice bool
 	apiKey             string
 	sysprompt          string
-	fileUri            string
+
+	mu          sync.Mutex
+	cancel      context.CancelFunc // cancels the message in flight, nil when idle
+	ended       chan struct{}      // closed when the message in flight has ended
+	attachments []pendingAttachment
+
+	// captureUI lets the user select and review screenshots, nil without UI
+	captureUI *CaptureUI
+
+	// onAttachmentsChanged is called when attachments are added, removed or sent
+	onAttachmentsChanged func()
 }
 
 func main() {
+	opts, ok := parseCLIOptions(os.Args[1:])
+	if ok && opts.enabled() {
+		os.Exit(runCLI(opts))
+	}
+
 	myApp := app.New()
 	myWindow := myApp.NewWindow("The Eye")
 	log.Println("The Eye started")
 
-	var err error
-	var gormdb *gorm.DB
-
-	aiapp := &App{}
-
-	gormdb, err = InitDB()
-	if err != nil {
-		log.Println("Error initializing database:", err)
+	aiapp, err := newApp()
+	if aiapp == nil || aiapp.provider == nil {
+		log.Println("Error starting The Eye:", err)
+		dialog.ShowError(err, myWindow)
+		myWindow.Resize(fyne.NewSize(350, 500))
+		myWindow.ShowAndRun()
 		return
 	}
-	db = gormdb
+	providerErr := err
+	defer func() { aiapp.provider.Close() }()
+	toolRegistry.Confirm = confirmToolCall(myWindow)
 
 	input := widget.NewEntry()
 	input.SetPlaceHolder("Enter your message here...")
 	input.Wrapping = fyne.TextWrapWord
 
-	apiKey := loadAPIKey()
-	aiapp.apiKey = apiKey
-	aiapp.client, err = NewClient(aiapp.apiKey, context.Background())
-	if err != nil {
-		dialog.ShowError(err, myWindow)
-		log.Println("Error creating client:", err)
-		return
-	}
-	defer closeClient(aiapp.client)
-
-	aiapp.model = NewModel(aiapp.client, GenaiModel)
-	aiapp.model.Tools = []*genai.Tool{FileTool}
-	aiapp.sysprompt = getSysPrompt()
-	aiapp.model.SystemInstruction = &genai.Content{Role: "user", Parts: []genai.Part{genai.Text(aiapp.sysprompt)}}
-	var maxTokens int32 = 1000
-	var temperature float32 = 0.9
-	aiapp.model.MaxOutputTokens = &maxTokens
-	aiapp.model.Temperature = &temperature
-	aiapp.cs = aiapp.model.StartChat()
-
 	messagesContainer := container.NewVBox()
 	scrollContent := container.NewVScroll(messagesContainer)
 
+	stopButton := widget.NewButtonWithIcon("", theme.MediaStopIcon(), func() {
+		aiapp.cancelMessage()
+	})
+	stopButton.Disable()
+
 	sendButton := widget.NewButtonWithIcon("Send", theme.MailSendIcon(), func() {
-		sendMessage(aiapp, input, messagesContainer, aiapp.cs, myWindow, scrollContent)
+		sendMessage(aiapp, input, messagesContainer, myWindow, scrollContent, stopButton)
 	})
 
 	input.OnSubmitted = func(text string) {
-		sendMessage(aiapp, input, messagesContainer, aiapp.cs, myWindow, scrollContent)
+		sendMessage(aiapp, input, messagesContainer, myWindow, scrollContent, stopButton)
+	}
+
+	attachmentBar := container.NewHBox()
+	attachmentScroll := container.NewHScroll(attachmentBar)
+	attachmentScroll.Hide()
+	aiapp.onAttachmentsChanged = func() {
+		attachmentBar.RemoveAll()
+		for i, attachment := range aiapp.pendingAttachments() {
+			chip := widget.NewButtonWithIcon(shortName(attachment.name, 24), theme.CancelIcon(), func() {
+				aiapp.removeAttachment(i)
+			})
+			chip.IconPlacement = widget.ButtonIconTrailingText
+			attachmentBar.Add(chip)
+		}
+		if len(attachmentBar.Objects) == 0 {
+			attachmentScroll.Hide()
+		} else {
+			attachmentScroll.Show()
+		}
+	}
+	addFile := func(path string) {
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			log.Println("Not attaching", path, err)
+			return
+		}
+		aiapp.addAttachment(pendingAttachment{name: filepath.Base(path), path: path})
 	}
 
-	var fileMsg string
-	var filePickerButton *widget.Button
 	var checkbox *widget.Check
 
 	clearButton := widget.NewButtonWithIcon("", theme.ContentClearIcon(), func() {
+		aiapp.stopMessage()
+		rememberConversation(aiapp, myWindow, nil)
 		messagesContainer.Objects = nil
-		aiapp.cs.History = nil
+		aiapp.cs.Reset()
 		messagesContainer.Refresh()
-		aiapp.fileUri = ""
-		filePickerButton.SetText("")
-		checkbox.Enable()
+		aiapp.takeAttachments()
 		checkbox.Checked = false
+		checkbox.Refresh()
 		aiapp.captureImageChoice = false
 	})
 
-	filePickerButton = widget.NewButtonWithIcon(fileMsg, theme.FileIcon(), func() {
+	filePickerButton := widget.NewButtonWithIcon("", theme.FileIcon(), func() {
 		newWindow := myApp.NewWindow("File Picker")
 		newWindow.Resize(fyne.NewSize(600, 400))
 
@@ -118,43 +145,59 @@ func main() {
 				newWindow.Close()
 				return
 			}
-			aiapp.fileUri = reader.URI().Path()
+			addFile(reader.URI().Path())
 			reader.Close()
-			fileName := filepath.Base(aiapp.fileUri)
-			if len(fileName) > 5 {
-				fileName = fileName[0:8] + ".."
-			}
-			filePickerButton.SetText(fileName)
-			checkbox.Checked = false
-			checkbox.Disable()
-			aiapp.captureImageChoice = false
 			newWindow.Close()
 		}, newWindow)
 
 		newWindow.Show()
 	})
 
-	settingsButton := widget.NewButtonWithIcon("", theme.SettingsIcon(), func() {
-		showSettingsDialog(aiapp, myWindow, func(apiKey string) {
-			newclient, err := NewClient(apiKey, context.Background())
+	myWindow.SetOnDropped(func(_ fyne.Position, uris []fyne.URI) {
+		for _, uri := range uris {
+			if uri.Scheme() == "file" {
+				addFile(uri.Path())
+			}
+		}
+	})
+
+	aiapp.captureUI = &CaptureUI{
+		SelectRegion: regionSelector(myApp, "Drag to select the region to send, Esc to cancel"),
+		Review:       screenshotReviewer(myApp),
+	}
+	screenshotButton := widget.NewButtonWithIcon("", theme.MediaPhotoIcon(), func() {
+		// the region selection and review wait for the user, keep the UI thread free
+		go func() {
+			myWindow.Hide()
+			part, attachment, err := screenAttachment(aiapp.captureUI)
+			myWindow.Show()
+			if err == errCaptureCancelled {
+				return
+			}
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("error capturing screen: %v", err), myWindow)
+				return
+			}
+			name := fmt.Sprintf("%s (%s)", attachment.Name, formatSize(attachment.Size))
+			aiapp.addAttachment(pendingAttachment{name: name, part: part, info: attachment})
+		}()
+	})
+
+	openSettings := func() {
+		showSettingsDialog(aiapp, myWindow, func(cfg ProviderConfig) {
+			newprovider, err := NewProvider(context.Background(), cfg)
 			if err != nil {
-				dialog.ShowError(fmt.Errorf("there was an error. Try again"), myWindow)
+				dialog.ShowError(fmt.Errorf("there was an error. Try again: %v", err), myWindow)
 				return
 			}
 
-			// rebuild the client
-			aiapp.client = newclient
-			aiapp.model = NewModel(aiapp.client, GenaiModel)
-			aiapp.model.Tools = []*genai.Tool{FileTool}
-			aiapp.sysprompt = getSysPrompt()
-			aiapp.model.SystemInstruction = &genai.Content{Role: "user", Parts: []genai.Part{genai.Text(aiapp.sysprompt)}}
-			var maxTokens int32 = 1000
-			var temperature float32 = 0.9
-			aiapp.model.MaxOutputTokens = &maxTokens
-			aiapp.model.Temperature = &temperature
-			aiapp.cs = aiapp.model.StartChat()
+			// rebuild the provider, keeping the current conversation
+			aiapp.provider.Close()
+			aiapp.provider = newprovider
+			aiapp.startChat()
 		})
-	})
+	}
+	settingsButton := widget.NewButtonWithIcon("", theme.SettingsIcon(), openSettings)
 
 	checkbox = widget.NewCheck("Send screen data", func(checked bool) {
 		aiapp.captureImageChoice = checked
@@ -162,265 +205,441 @@ func main() {
 
 	checkbox.Checked = false
 
-	topContainer := container.NewBorder(nil, nil, nil, container.NewHBox(filePickerButton, settingsButton, clearButton))
+	sidebar, refreshHistory := newHistorySidebar(myWindow, func(conversation Conversation) {
+		err := openConversation(aiapp, conversation, messagesContainer, scrollContent)
+		if err != nil {
+			dialog.ShowError(err, myWindow)
+		}
+	})
+	sidebar.Hide()
+
+	historyButton := widget.NewButtonWithIcon("", theme.HistoryIcon(), func() {
+		if sidebar.Visible() {
+			sidebar.Hide()
+			return
+		}
+		refreshHistory()
+		sidebar.Show()
+	})
+
+	topContainer := container.NewBorder(nil, nil, historyButton, container.NewHBox(filePickerButton, screenshotButton, settingsButton, clearButton))
 
 	inputContainer := container.NewVBox(
+		attachmentScroll,
 		checkbox,
-		container.NewBorder(nil, nil, nil, sendButton, input),
+		container.NewBorder(nil, nil, nil, container.NewHBox(stopButton, sendButton), input),
 	)
 
-	mainContainer := container.New(layout.NewBorderLayout(topContainer, inputContainer, nil, nil),
-		scrollContent, inputContainer, topContainer)
+	mainContainer := container.New(layout.NewBorderLayout(topContainer, inputContainer, sidebar, nil),
+		scrollContent, inputContainer, topContainer, sidebar)
 	myWindow.SetContent(mainContainer)
 
+	myWindow.SetCloseIntercept(func() {
+		aiapp.stopMessage()
+		rememberConversation(aiapp, myWindow, myWindow.Close)
+	})
+
+	if providerErr != nil {
+		// let the user fix the provider settings the app could not start with
+		errorDialog := dialog.NewError(providerErr, myWindow)
+		errorDialog.SetOnClosed(openSettings)
+		errorDialog.Show()
+	}
+
 	myWindow.Resize(fyne.NewSize(350, 500))
 	myWindow.ShowAndRun()
 
 }
 
-func sendMessage(app *App, input *widget.Entry, messagesContainer *fyne.Container, cs *genai.ChatSession, myWindow fyne.Window, scrollContent *container.Scroll) {
+// confirmToolCall returns a ConfirmFunc asking the user in a dialog
+func confirmToolCall(window fyne.Window) ConfirmFunc {
+	return func(ctx context.Context, tool Tool, args map[string]any, preview string) (bool, error) {
+		answer := make(chan bool, 1)
+
+		previewLabel := widget.NewLabel(preview)
+		previewLabel.Wrapping = fyne.TextWrapBreak
+		previewLabel.TextStyle = fyne.TextStyle{Monospace: true}
+		always := widget.NewCheck("Always allow "+tool.Name(), nil)
+		content := container.NewBorder(widget.NewLabel("The assistant wants to run "+tool.Name()+":"), always, nil, nil,
+			container.NewVScroll(previewLabel))
+
+		d := dialog.NewCustomConfirm("Allow "+tool.Name()+"?", "Allow", "Deny", content, func(ok bool) {
+			if ok && always.Checked {
+				if err := SaveToolPolicy(db, tool.Name(), PolicyAllow); err != nil {
+					log.Println("Error saving tool policy:", err)
+				}
+			}
+			answer <- ok
+		}, window)
+		d.Resize(fyne.NewSize(450, 400))
+		d.Show()
+
+		select {
+		case ok := <-answer:
+			return ok, nil
+		case <-ctx.Done():
+			d.Hide()
+			return false, ctx.Err()
+		}
+	}
+}
+
+// rememberConversation offers the facts of the current conversation worth
+// remembering for the user to accept, if that is enabled, and calls done
+// afterwards. The conversation may be reset meanwhile.
+func rememberConversation(app *App, window fyne.Window, done func()) {
+	if done == nil {
+		done = func() {}
+	}
+	history := app.cs.History()
+	if !summaryEnabled() || !worthSummarizing(history) {
+		done()
+		return
+	}
+	var conversationID *uint
+	if app.cs.conversation != nil {
+		id := app.cs.conversation.ID
+		conversationID = &id
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := dialog.NewCustom("Remember", "Skip",
+		container.NewVBox(widget.NewLabel("Looking for facts worth remembering..."), widget.NewProgressBarInfinite()), window)
+	progress.SetOnClosed(cancel)
+	progress.Show()
+
+	go func() {
+		candidates, err := summarizeConversation(ctx, app.provider, history)
+		skipped := ctx.Err() != nil
+		progress.Hide()
+		switch {
+		case skipped:
+			done()
+		case err != nil:
+			log.Println("Error summarizing conversation:", err)
+			errorDialog := dialog.NewError(fmt.Errorf("error looking for facts to remember: %v", err), window)
+			errorDialog.SetOnClosed(done)
+			errorDialog.Show()
+		case len(candidates) == 0:
+			done()
+		default:
+			showMemoryCandidates(window, candidates, conversationID, done)
+		}
+	}()
+}
+
+// showMemoryCandidates lets the user choose the facts to save to memory
+func showMemoryCandidates(window fyne.Window, candidates []memoryCandidate, conversationID *uint, done func()) {
+	checks := make([]*widget.Check, len(candidates))
+	list := container.NewVBox()
+	for i, candidate := range candidates {
+		text := candidate.Item.Title + ": " + candidate.Item.Value
+		if candidate.Item.Description != "" {
+			text += "\n" + candidate.Item.Description
+		}
+		if candidate.Previous != nil {
+			text += "\nReplaces: " + candidate.Previous.Value
+		}
+		label := widget.NewLabel(text)
+		label.Wrapping = fyne.TextWrapWord
+		checks[i] = widget.NewCheck("", nil)
+		checks[i].SetChecked(true)
+		list.Add(container.NewBorder(nil, nil, checks[i], nil, label))
+	}
+	content := container.NewBorder(widget.NewLabel("Remember these facts from the conversation?"), nil, nil, nil,
+		container.NewVScroll(list))
+
+	d := dialog.NewCustomConfirm("Remember", "Remember", "Skip", content, func(ok bool) {
+		var failed []string
+		for i, candidate := range candidates {
+			if !ok || !checks[i].Checked {
+				continue
+			}
+			item := candidate.Item
+			item.ConversationID = conversationID
+			if _, err := UpsertData(db, item); err != nil {
+				log.Println("Error saving memory:", err)
+				failed = append(failed, item.Title)
+			}
+		}
+		if len(failed) == 0 {
+			done()
+			return
+		}
+		errorDialog := dialog.NewError(fmt.Errorf("error saving to memory: %s", strings.Join(failed, ", ")), window)
+		errorDialog.SetOnClosed(done)
+		errorDialog.Show()
+	}, window)
+	d.Resize(fyne.NewSize(450, 400))
+	d.Show()
+}
+
+// openConversation replaces the current chat with a saved conversation
+func openConversation(app *App, conversation Conversation, messagesContainer *fyne.Container, scrollContent *container.Scroll) error {
+	history, _, err := loadConversation(conversation.ID, uploadAccount(app.provider))
+	if err != nil {
+		return err
+	}
+	app.stopMessage()
+	app.cs.Reset()
+	app.cs.SetHistory(history)
+	app.cs.conversation = &conversation
+
+	messagesContainer.Objects = nil
+	for _, content := range history {
+		text := messageText(content)
+		if text == "" {
+			continue
+		}
+		sender := "You"
+		if content.Role == "model" {
+			sender = "AI"
+		}
+		addMessage(messagesContainer, sender, text, scrollContent)
+	}
+	messagesContainer.Refresh()
+	scrollContent.ScrollToBottom()
+	return nil
+}
+
+// newHistorySidebar returns the list of saved conversations and a function to reload it
+func newHistorySidebar(window fyne.Window, onOpen func(conversation Conversation)) (fyne.CanvasObject, func()) {
+	var conversations []Conversation
+	var list *widget.List
+
+	refresh := func() {
+		var err error
+		conversations, err = ListConversations(db)
+		if err != nil {
+			log.Println("Error listing conversations:", err)
+		}
+		list.UnselectAll()
+		list.Refresh()
+	}
+
+	list = widget.NewList(
+		func() int {
+			return len(conversations)
+		},
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Truncation = fyne.TextTruncateEllipsis
+			return container.NewBorder(nil, nil, nil, widget.NewButtonWithIcon("", theme.DeleteIcon(), nil), label)
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			conversation := conversations[id]
+			row := item.(*fyne.Container)
+			row.Objects[0].(*widget.Label).SetText(conversation.Title)
+			row.Objects[1].(*widget.Button).OnTapped = func() {
+				dialog.ShowConfirm("Delete conversation", "Delete \""+conversation.Title+"\"?", func(ok bool) {
+					if !ok {
+						return
+					}
+					if err := DeleteConversation(db, conversation.ID); err != nil {
+						dialog.ShowError(err, window)
+						return
+					}
+					refresh()
+				}, window)
+			}
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		onOpen(conversations[id])
+		list.Unselect(id)
+	}
+
+	minWidth := canvas.NewRectangle(color.Transparent)
+	minWidth.SetMinSize(fyne.NewSize(180, 0))
+	sidebar := container.NewStack(minWidth, container.NewBorder(widget.NewLabel("History"), nil, nil, nil, list))
+	return sidebar, refresh
+}
+
+func sendMessage(app *App, input *widget.Entry, messagesContainer *fyne.Container, myWindow fyne.Window, scrollContent *container.Scroll, stopButton *widget.Button) {
 	prompt := input.Text
 	if prompt == "" {
 		return
 	}
-	addMessage(messagesContainer, "You", prompt, scrollContent)
+	ctx, ok := app.beginMessage()
+	if !ok {
+		return
+	}
+	attachments := app.takeAttachments()
+	message := addMessage(messagesContainer, "You", prompt, scrollContent)
 	input.SetText("")
+	stopButton.Enable()
 
 	go func() {
-		var res *genai.GenerateContentResponse
-		var imageBytes []byte
-		var err error
-		var reserr error
+		defer func() {
+			app.endMessage()
+			stopButton.Disable()
+		}()
+
+		reply := addMessage(messagesContainer, "AI", "", scrollContent)
+		// nothing was sent, the attachments are queued again
+		fail := func(err error) {
+			app.restoreAttachments(attachments)
+			reply.SetText(errorText(err))
+		}
 
-		if app.fileUri != "" {
-			fileContent, err := os.ReadFile(app.fileUri)
-			if err != nil {
-				dialog.ShowError(err, myWindow)
-				app.fileUri = ""
-				return
-			}
-			fileType, err := getFileMimeType(app.fileUri)
+		app.refreshSystemPrompt(ctx, prompt)
+		parts := []genai.Part{genai.Text(prompt)}
+
+		var infos []Attachment
+		for _, pending := range attachments {
+			part, attachment, err := pending.load(ctx, app.provider)
 			if err != nil {
-				dialog.ShowError(err, myWindow)
-				app.fileUri = ""
+				fail(fmt.Errorf("error attaching %s: %v", pending.name, err))
 				return
 			}
-			fileBlob := genai.Blob{
-				MIMEType: fileType,
-				Data:     fileContent, //TODO problems with txt file. maybe read the file and send raw text
-			}
-
-			res, reserr = cs.SendMessage(context.Background(), genai.Text(prompt), fileBlob)
-			app.fileUri = ""
-		} else if app.captureImageChoice {
+			parts = append(parts, part)
+			infos = append(infos, attachment)
+		}
+		if app.captureImageChoice {
 			myWindow.Hide()
-			imageBytes, err = captureScreen()
+			part, attachment, err := screenAttachment(app.captureUI)
 			myWindow.Show()
+			if err == errCaptureCancelled {
+				fail(fmt.Errorf("the screenshot was cancelled, the message was not sent"))
+				return
+			}
 			if err != nil {
-				log.Println("Error capturing screen:", err)
+				fail(fmt.Errorf("error capturing screen, the message was not sent: %v", err))
 				return
 			}
-			res, reserr = cs.SendMessage(context.Background(), genai.Text(prompt), genai.ImageData("png", imageBytes))
-		} else {
-			res, reserr = cs.SendMessage(context.Background(), genai.Text(prompt))
+			parts = append(parts, part)
+			infos = append(infos, attachment)
+		}
+		app.cs.Attach(infos...)
+		// parts after the prompt are the attachments, in the order of infos
+		for i, part := range parts[1:] {
+			if blob, ok := part.(genai.Blob); ok && strings.HasPrefix(blob.MIMEType, "image/") {
+				message.AddImage(blob.Data, fmt.Sprintf("%s (%s)", infos[i].Name, formatSize(infos[i].Size)))
+			}
 		}
 
-		if reserr != nil {
-			var blockedErr *genai.BlockedError
-			var apiErr *apierror.APIError
-
-			if errors.As(reserr, &blockedErr) {
-				addMessage(messagesContainer, "AI", "Error: Message blocked", scrollContent)
-				return
-			} else if errors.As(reserr, &apiErr) {
-				addMessage(messagesContainer, "AI", "Error: API error. Could not process request. Make sure your API key is set correctly.", scrollContent)
-				return
+		showError := func(err error) {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			if reply.Text() == "" {
+				reply.SetText(errorText(err))
 			} else {
-				errortext := "Error: " + reserr.Error()
-				addMessage(messagesContainer, "AI", errortext, scrollContent)
-				println("Error sending message:", reserr.Error())
-				return
+				reply.Append("\n\n" + errorText(err))
 			}
-
 		}
 
-		if res == nil {
-			addMessage(messagesContainer, "AI", "Error: empty response", scrollContent)
+		// the settings only store the limit, the engine is not touched while a message is sent
+		app.engine.MaxToolRounds = loadMaxToolRounds()
+		response, err := app.engine.Send(ctx, func(event Event) {
+			switch event.Type {
+			case EventAssistantDelta:
+				reply.Append(event.Text)
+			case EventToolCallFinished:
+				reply.AddToolCall(event.Tool)
+			}
+		}, parts...)
+		if err != nil {
+			showError(err)
 			return
 		}
-
-		addMessage(messagesContainer, "AI", buildResponse(res, cs), scrollContent)
-
+		if reply.Text() == "" {
+			if response == "" {
+				response = "Error: empty response"
+			}
+			reply.SetText(response)
+		}
 	}()
 
 }
 
-// buildResponse builds a string response based on content parts from candidates
-func buildResponse(resp *genai.GenerateContentResponse, cs *genai.ChatSession) string {
-	var response genai.Text
-	funcResponse := make(map[string]interface{})
-	var err error
-
-	for _, part := range resp.Candidates[0].Content.Parts {
-		functionCall, ok := part.(genai.FunctionCall)
-		if ok {
-			log.Println("Function call:", functionCall.Name)
-			switch functionCall.Name {
-			case "file_write":
-				fileName, fileNameOk := functionCall.Args["fileName"].(string)
-				content, contentOk := functionCall.Args["content"].(string)
-
-				if !fileNameOk || fileName == "" {
-					funcResponse["error"] = "expected non-empty string at key 'fileName'"
-					break
-				}
-				if !contentOk || content == "" {
-					funcResponse["error"] = "expected non-empty string at key 'content'"
-					break
-				}
-
-				err := WriteDesktop(fileName, content)
-				if err != nil {
-					funcResponse["error"] = "error writing file: " + err.Error()
-				} else {
-					funcResponse["result"] = "file written to user Desktop."
-				}
-
-			case "file_read":
-				fileName, fileNameOk := functionCall.Args["fileName"].(string)
-				if !fileNameOk || fileName == "" {
-					funcResponse["error"] = "expected non-empty string at key 'fileName'"
-					break
-				}
-				fileContent, err := ReadDesktopFile(fileName)
-				if err != nil {
-					funcResponse["error"] = err.Error()
-				} else {
-					funcResponse["result"] = string(fileContent)
-				}
-			case "file_list":
-				files, err := OutDesktopFiles()
-				if err != nil {
-					funcResponse["error"] = err.Error()
-				} else {
-					funcResponse["result"] = strings.Join(files, ", ")
-				}
-			case "memory_read":
-				data, err := ReadMemory()
-				if err != nil {
-					funcResponse["error"] = err.Error()
-				} else {
-					funcResponse["result"] = data
-				}
-			case "memory_write":
-				key, keyOk := functionCall.Args["title"].(string)
-				value, valueOk := functionCall.Args["value"].(string)
-				description, descOk := functionCall.Args["description"].(string)
-
-				if !keyOk || key == "" {
-					funcResponse["error"] = "expected non-empty string at key 'title'"
-					break
-				}
-				if !valueOk || value == "" {
-					funcResponse["error"] = "expected non-empty string at key 'value'"
-					break
-				}
-				if !descOk || description == "" {
-					funcResponse["error"] = "expected non-empty string at key 'description'"
-					break
-				}
+// chatMessage is a message card whose markdown content can grow while it is
+// streamed, tool calls made for the message are listed under it
+type chatMessage struct {
+	label    *widget.RichText
+	scroll   *container.Scroll
+	images   *fyne.Container   // thumbnails of attached images
+	activity *widget.Accordion // "Tool activity" section, hidden until the first call
+	calls    *widget.Accordion // one item per call inside the section
+	mu       sync.Mutex
+	text     string
+	numCalls int
+}
 
-				err := WriteMemory(key, value, description)
-				if err != nil {
-					funcResponse["error"] = err.Error()
-				} else {
-					funcResponse["result"] = "value written to memory"
-				}
-			default:
-				funcResponse["error"] = "unknown function call"
-			}
-		}
+// AddToolCall adds a finished tool call to the tool activity section
+func (m *chatMessage) AddToolCall(call *ToolCall) {
+	title := fmt.Sprintf("%s (%s)", call.Name, call.Duration.Round(time.Millisecond))
+	if call.Err != nil {
+		title = fmt.Sprintf("%s failed (%s)", call.Name, call.Duration.Round(time.Millisecond))
 	}
+	detail := widget.NewLabel("Arguments: " + toolCallJSON(call.Args) + "\n" + "Result: " + toolCallJSON(call.response()))
+	detail.Wrapping = fyne.TextWrapBreak
+	detail.TextStyle = fyne.TextStyle{Monospace: true}
+
+	m.mu.Lock()
+	m.numCalls++
+	numCalls := m.numCalls
+	m.mu.Unlock()
+
+	m.calls.Append(widget.NewAccordionItem(title, detail))
+	m.activity.Items[0].Title = fmt.Sprintf("Tool activity (%d)", numCalls)
+	m.activity.Refresh()
+	m.activity.Show()
+}
 
-	if len(funcResponse) > 0 {
-		resp, err = cs.SendMessage(context.Background(), genai.FunctionResponse{
-			Name:     "Function_Call",
-			Response: funcResponse,
-		})
-		if err != nil {
-			return "Error sending message: " + err.Error()
-		}
-		funcResponse = nil
-		return buildResponse(resp, cs)
-	}
+// AddImage shows a thumbnail of an attached image with a caption, e.g. its
+// name and the size sent
+func (m *chatMessage) AddImage(data []byte, caption string) {
+	thumbnail := canvas.NewImageFromResource(fyne.NewStaticResource("attachment", data))
+	thumbnail.FillMode = canvas.ImageFillContain
+	thumbnail.SetMinSize(fyne.NewSize(160, 100))
+	label := widget.NewLabelWithStyle(caption, fyne.TextAlignCenter, fyne.TextStyle{Italic: true})
+	m.images.Add(container.NewVBox(thumbnail, label))
+	m.images.Show()
+	m.scroll.ScrollToBottom()
+}
 
-	for _, cand := range resp.Candidates {
-		if cand.Content != nil {
-			for _, part := range cand.Content.Parts {
-				res, ok := part.(genai.Text)
-				if ok {
-					log.Println("Response:", res)
-					return string(res)
-				}
+func (m *chatMessage) Text() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.text
+}
 
-			}
+func (m *chatMessage) SetText(text string) {
+	m.mu.Lock()
+	m.text = text
+	m.mu.Unlock()
+	m.label.ParseMarkdown(text)
+	m.scroll.ScrollToBottom()
+}
 
-		}
-	}
-	return string(response)
+// Append adds a streamed chunk to the message
+func (m *chatMessage) Append(text string) {
+	m.mu.Lock()
+	m.text += text
+	content := m.text
+	m.mu.Unlock()
+	m.label.ParseMarkdown(content)
+	m.scroll.ScrollToBottom()
 }
 
-func addMessage(container *fyne.Container, sender, content string, scrollContent *container.Scroll) {
+func addMessage(messagesContainer *fyne.Container, sender, content string, scrollContent *container.Scroll) *chatMessage {
 	label := widget.NewRichTextFromMarkdown(content)
 	label.Wrapping = fyne.TextWrapWord
 
-	card := widget.NewCard(sender, "", label)
-	container.Add(card)
+	images := container.NewHBox()
+	images.Hide()
+
+	calls := widget.NewAccordion()
+	activity := widget.NewAccordion(widget.NewAccordionItem("Tool activity", calls))
+	activity.Hide()
+
+	card := widget.NewCard(sender, "", container.NewVBox(label, images, activity))
+	messagesContainer.Add(card)
 	if sender == "You" {
 		scrollContent.ScrollToBottom()
 	}
-}
-
-func showSettingsDialog(app *App, window fyne.Window, onSave func(apiKey string)) {
-	apiKeyEntry := widget.NewEntry()
-	apiKeyEntry.SetText(app.apiKey)
-
-	var rowsCount int64
-
-	rowsCount, _ = CountRows(db)
-	itemsStoredLabel := widget.NewLabel("Items stored in memory: " + fmt.Sprint(rowsCount))
-	content := container.NewVBox(
-		widget.NewLabel("API Key:"),
-		apiKeyEntry,
-		itemsStoredLabel,
-		widget.NewButton("Clear memory", func() {
-			err := DeleteData(db)
-			if err != nil {
-				dialog.ShowError(err, window)
-				return
-			}
-			rowsCount, _ = CountRows(db)
-			itemsStoredLabel.SetText(fmt.Sprintf("Items stored in memory: %d", rowsCount))
-			dialog.ShowInformation("Memory Cleared", "Memory has been cleared", window)
-		}),
-		widget.NewLabel("Version: "+VERSION),
-		widget.NewLabel("pilsnerbeer/the_eye_chatbot"),
-	)
-
-	dialog.ShowCustomConfirm("Settings", "Save", "Cancel", content, func(save bool) {
-		if save {
-			newAPIKey := apiKeyEntry.Text
-			if newAPIKey != app.apiKey {
-				app.apiKey = newAPIKey
-				err := saveAPIKey(app.apiKey)
-				if err != nil {
-					log.Println("Error saving API key:", err)
-					return
-				}
-				onSave(app.apiKey)
-			}
-		}
-	}, window)
+	return &chatMessage{label: label, scroll: scrollContent, images: images, activity: activity, calls: calls, text: content}
 }
 
 func getAppSupportDir() (string, error) {
@@ -460,20 +679,28 @@ func saveAPIKey(apiKey string) error {
 	return nil
 }
 
-func getSysPrompt() string {
+// getSysPrompt returns the system prompt with the memory relevant to the
+// user's message, see relevantMemory
+func getSysPrompt(ctx context.Context, message string) string {
 	log.Println("Getting system prompt")
 	basePrompt := "You are an EXTREMELY helpful assistant called The Eye who is an expert in every field and has vast knowledge about various topics. You help the user with their tasks and answer their questions. Be friendly and helpful. Utilize tools when necessary. You have access to long-term memory tool, which helps you remember things across time. write and read from it whenever necessary, when you feel that certain information might need to be remembered for later (Such as personal user information, reminders, specific instructions, etc.)."
-	memoryPrompt := "Your long-term memory values are as follows: (in format: Title: Description - Value)\n"
-	memVals, err := DumpRows(db)
-	var mainPrompt string
+	memoryPrompt := "Your long-term memory values relevant to this message are as follows, search for others with memory_search: (in format: Title: Description - Value)\n"
+	basePrompt += " The file tools can access these folders (relative file names are in the first one): " + strings.Join(workspaceRoots(), ", ") + ". "
+	items, err := relevantMemory(ctx, message)
 	if err != nil {
-		log.Println("Error dumping rows:", err)
+		log.Println("Error reading memory:", err)
 		return basePrompt
-	} else {
-		mainPrompt = basePrompt + memoryPrompt + memVals
-		return mainPrompt
 	}
+	return basePrompt + memoryPrompt + formatMemory(items)
+}
 
+// shortName shortens a file name to limit characters for buttons and chips
+func shortName(name string, limit int) string {
+	runes := []rune(name)
+	if len(runes) <= limit {
+		return name
+	}
+	return string(runes[:limit-2]) + ".."
 }
 
 func getFileMimeType(filePath string) (string, error) {
@@ -484,12 +711,12 @@ func getFileMimeType(filePath string) (string, error) {
 	defer file.Close()
 
 	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
-	if err != nil {
+	n, err := file.Read(buffer)
+	if err != nil && err != io.EOF {
 		return "", err
 	}
 
-	mimeType := http.DetectContentType(buffer)
+	mimeType := http.DetectContentType(buffer[:n])
 	if mimeType == "application/octet-stream" {
 		ext := filepath.Ext(filePath)
 		mimeType = mime.TypeByExtension(ext)
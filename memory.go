@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	memoryTopK        = 10 // memory items given to the model with a message besides the pinned ones
+	maxMemoryKeywords = 20 // words of a message or query searched for
+	maxMemoryResults  = 50 // results memory_search returns at most
+
+	// how long sending waits for the embedding search, the keyword matches
+	// are used alone when it takes longer
+	memoryPromptWait = 2 * time.Second
+)
+
+var memoryWriteSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"title": {
+			Type:        genai.TypeString,
+			Description: "The title of the memory value, for example username. Writing a title that exists replaces its value.",
+		},
+		"description": {
+			Type:        genai.TypeString,
+			Description: "The description of the memory value, for example Name of the User.",
+		},
+		"value": {
+			Type:        genai.TypeString,
+			Description: "The value of the memory value, for example Thomas.",
+		},
+	},
+	Required: []string{"title", "description", "value"},
+}
+
+var memorySearchSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"query": {
+			Type:        genai.TypeString,
+			Description: "What to search for, for example birthday of my sister. Values related in meaning are found too",
+		},
+		"limit": {
+			Type:        genai.TypeInteger,
+			Description: "The number of values to return, 10 if not given",
+		},
+	},
+	Required: []string{"query"},
+}
+
+var memoryUpdateSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"title": {
+			Type:        genai.TypeString,
+			Description: "The title of the memory value to change",
+		},
+		"newTitle": {
+			Type:        genai.TypeString,
+			Description: "A new title, to rename the value",
+		},
+		"description": {
+			Type:        genai.TypeString,
+			Description: "A new description",
+		},
+		"value": {
+			Type:        genai.TypeString,
+			Description: "A new value",
+		},
+	},
+	Required: []string{"title"},
+}
+
+var memoryDeleteSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"title": {
+			Type:        genai.TypeString,
+			Description: "The title of the memory value to forget",
+		},
+	},
+	Required: []string{"title"},
+}
+
+type memoryReadTool struct{}
+
+func (memoryReadTool) Name() string { return "memory_read" }
+
+func (memoryReadTool) Description() string {
+	return "returns the long term memory database with all values"
+}
+
+func (memoryReadTool) Schema() *genai.Schema { return nil }
+
+func (memoryReadTool) ReadOnly() bool { return true }
+
+func (memoryReadTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	data, err := ReadMemory()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"result": data}, nil
+}
+
+type memorySearchTool struct{}
+
+func (memorySearchTool) Name() string { return "memory_search" }
+
+func (memorySearchTool) Description() string {
+	return "search the long term memory database for values about something, the best matches first. " +
+		"Only the memory relevant to the user's message is given to you, search for anything else you need to know"
+}
+
+func (memorySearchTool) Schema() *genai.Schema { return memorySearchSchema }
+
+func (memorySearchTool) ReadOnly() bool { return true }
+
+func (memorySearchTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	query := args["query"].(string)
+	if len(memoryKeywords(query)) == 0 && memoryEmbedder() == nil {
+		return nil, fmt.Errorf("the query has no words to search for")
+	}
+	limit := memoryTopK
+	if l, ok := args["limit"].(float64); ok {
+		limit = min(max(int(l), 1), maxMemoryResults)
+	}
+	items, err := searchMemory(ctx, query, limit, embeddingTimeout)
+	if err != nil {
+		return nil, err
+	}
+	results := []any{}
+	for _, item := range items {
+		results = append(results, map[string]any{
+			"title":       item.Title,
+			"description": item.Description,
+			"value":       item.Value,
+			"updated":     item.UpdatedAt.Format("2006-01-02"),
+		})
+	}
+	return map[string]any{"result": results}, nil
+}
+
+type memoryWriteTool struct{}
+
+func (memoryWriteTool) Name() string { return "memory_write" }
+
+func (memoryWriteTool) Description() string {
+	return "write a value to the long term memory database to remember it forever, a value with the same title is replaced"
+}
+
+func (memoryWriteTool) Schema() *genai.Schema { return memoryWriteSchema }
+
+func (memoryWriteTool) ReadOnly() bool { return false }
+
+func (memoryWriteTool) Preview(args map[string]any) string {
+	title := memoryTitle(args["title"])
+	if existing, err := GetData(db, title); err == nil {
+		return fmt.Sprintf("Replace in long term memory:\n\n%s: %s - %s\n\nwith\n\n%s: %s - %s",
+			existing.Title, existing.Description, existing.Value, title, args["description"], args["value"])
+	}
+	return fmt.Sprintf("Remember in long term memory:\n\n%s: %s - %s", title, args["description"], args["value"])
+}
+
+func (memoryWriteTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	previous, err := WriteMemory(ctx, memoryTitle(args["title"]), args["description"].(string), args["value"].(string))
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		return map[string]any{"result": "value replaced in memory", "previousValue": previous.Value}, nil
+	}
+	return map[string]any{"result": "value written to memory"}, nil
+}
+
+type memoryUpdateTool struct{}
+
+func (memoryUpdateTool) Name() string { return "memory_update" }
+
+func (memoryUpdateTool) Description() string {
+	return "change the title, description or value of a value in the long term memory database, fields which are left out stay as they are"
+}
+
+func (memoryUpdateTool) Schema() *genai.Schema { return memoryUpdateSchema }
+
+func (memoryUpdateTool) ReadOnly() bool { return false }
+
+func (memoryUpdateTool) Preview(args map[string]any) string {
+	title := memoryTitle(args["title"])
+	var changes []string
+	for _, field := range [][2]string{{"newTitle", "title"}, {"description", "description"}, {"value", "value"}} {
+		if value, ok := args[field[0]].(string); ok {
+			changes = append(changes, fmt.Sprintf("%s: %s", field[1], value))
+		}
+	}
+	return fmt.Sprintf("Change %q in long term memory:\n\n%s", title, strings.Join(changes, "\n"))
+}
+
+func (memoryUpdateTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	title := memoryTitle(args["title"])
+	updates := map[string]any{}
+	if newTitle, ok := args["newTitle"].(string); ok {
+		if newTitle = memoryTitle(newTitle); newTitle == "" {
+			return nil, fmt.Errorf("newTitle must not be empty")
+		}
+		updates["title"] = newTitle
+	}
+	for _, field := range []string{"description", "value"} {
+		if value, ok := args[field].(string); ok {
+			updates[field] = value
+		}
+	}
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("nothing to change, give a newTitle, description or value")
+	}
+	if id, ok := conversationID(ctx); ok {
+		updates["conversation_id"] = id
+	}
+
+	previous, err := UpdateData(db, title, updates)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, &ToolError{Code: ErrCodeNotFound, Message: "there is no memory value titled " + title}
+	}
+	if errors.Is(err, ErrTitleTaken) {
+		return nil, &ToolError{Code: ErrCodeExists, Message: fmt.Sprintf("there is a memory value titled %s already, delete or update it instead", updates["title"])}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"result": "memory value changed", "previousValue": previous.Value}, nil
+}
+
+type memoryDeleteTool struct{}
+
+func (memoryDeleteTool) Name() string { return "memory_delete" }
+
+func (memoryDeleteTool) Description() string {
+	return "delete a value from the long term memory database"
+}
+
+func (memoryDeleteTool) Schema() *genai.Schema { return memoryDeleteSchema }
+
+func (memoryDeleteTool) ReadOnly() bool { return false }
+
+func (memoryDeleteTool) Preview(args map[string]any) string {
+	title := memoryTitle(args["title"])
+	if existing, err := GetData(db, title); err == nil {
+		return fmt.Sprintf("Forget from long term memory:\n\n%s: %s - %s", existing.Title, existing.Description, existing.Value)
+	}
+	return fmt.Sprintf("Forget %q from long term memory (there is no such value)", title)
+}
+
+func (memoryDeleteTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	title := memoryTitle(args["title"])
+	ok, err := DeleteDataByTitle(db, title)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &ToolError{Code: ErrCodeNotFound, Message: "there is no memory value titled " + title}
+	}
+	return map[string]any{"result": "memory value deleted"}, nil
+}
+
+// relevantMemory returns the pinned memory items and the memoryTopK items
+// matching message best
+func relevantMemory(ctx context.Context, message string) ([]UserData, error) {
+	items, err := PinnedData(db)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := searchMemory(ctx, message, memoryTopK, memoryPromptWait)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		if !match.Pinned {
+			items = append(items, match)
+		}
+	}
+	return items, nil
+}
+
+// searchMemory returns up to limit memory items for query: those related in
+// meaning first, if embeddings are on, then those sharing keywords. If the
+// embedding search takes longer than wait, or ctx is done first, it goes on
+// in the background so the vectors are stored for the next time.
+func searchMemory(ctx context.Context, query string, limit int, wait time.Duration) ([]UserData, error) {
+	var items []UserData
+	if embedder := memoryEmbedder(); embedder != nil && strings.TrimSpace(query) != "" {
+		done := make(chan []UserData, 1)
+		go func() {
+			done <- relatedMemory(embedder, query, limit)
+		}()
+		select {
+		case items = <-done:
+		case <-time.After(wait):
+			log.Println("Memory embedding search is slow, using keyword matches")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	matches, err := SearchData(db, memoryKeywords(query), limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		if len(items) >= limit {
+			break
+		}
+		if !slices.ContainsFunc(items, func(item UserData) bool { return item.ID == match.ID }) {
+			items = append(items, match)
+		}
+	}
+	return items, nil
+}
+
+// relatedMemory returns the result of semanticSearch, nil if it fails. If
+// the provider can't compute embeddings the local embedder is used. It
+// doesn't use the context of the message, stopping the message must not
+// throw away the vectors computed so far.
+func relatedMemory(embedder Embedder, query string, limit int) []UserData {
+	ctx, cancel := context.WithTimeout(context.Background(), embeddingTimeout)
+	defer cancel()
+	related, err := semanticSearch(ctx, embedder, query, limit)
+	if _, local := embedder.(localEmbedder); err != nil && !local {
+		log.Println("Memory embedding search failed, using local embeddings:", err)
+		related, err = semanticSearch(context.Background(), localEmbedder{}, query, limit)
+	}
+	if err != nil {
+		log.Println("Memory embedding search failed:", err)
+	}
+	return related
+}
+
+// formatMemory lists memory items for the system prompt
+func formatMemory(items []UserData) string {
+	var output string
+	for _, item := range items {
+		output += item.Title + " - " + item.Description + " - " + item.Value + "\n"
+	}
+	return output
+}
+
+// memoryStopWords are too common to find anything in memory
+var memoryStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "you": true, "your": true, "are": true, "was": true, "were": true,
+	"what": true, "who": true, "how": true, "why": true, "when": true, "where": true, "which": true,
+	"that": true, "this": true, "these": true, "those": true, "with": true, "have": true, "has": true, "had": true,
+	"can": true, "could": true, "would": true, "should": true, "will": true, "not": true, "but": true,
+	"about": true, "from": true, "into": true, "they": true, "them": true, "their": true, "there": true,
+	"then": true, "than": true, "also": true, "just": true, "please": true, "tell": true, "know": true,
+	"does": true, "did": true, "its": true, "our": true, "all": true, "any": true, "some": true,
+	"get": true, "got": true, "let": true, "make": true, "want": true, "need": true, "like": true,
+}
+
+// memoryKeywords returns the distinct words of text worth searching memory
+// for, in lower case
+func memoryKeywords(text string) []string {
+	seen := map[string]bool{}
+	var keywords []string
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if utf8.RuneCountInString(word) < 3 || memoryStopWords[word] || seen[word] {
+			continue
+		}
+		seen[word] = true
+		keywords = append(keywords, word)
+		if len(keywords) == maxMemoryKeywords {
+			break
+		}
+	}
+	return keywords
+}
+
+// memoryTitle normalizes a title argument, surrounding spaces don't make a new title
+func memoryTitle(arg any) string {
+	title, _ := arg.(string)
+	return strings.TrimSpace(title)
+}
+
+// WriteMemory saves a value under its title, replacing the value with that
+// title if there is one, which is returned
+func WriteMemory(ctx context.Context, title string, description string, value string) (*UserData, error) {
+	db, err := GetDB()
+	if err != nil {
+		return nil, err
+	}
+	if title == "" {
+		return nil, fmt.Errorf("title must not be empty")
+	}
+	item := UserData{Title: title, Description: description, Value: value}
+	if id, ok := conversationID(ctx); ok {
+		item.ConversationID = &id
+	}
+	return UpsertData(db, item)
+}
+
+func ReadMemory() (string, error) {
+	var (
+		db  *gorm.DB
+		err error
+	)
+	db, err = GetDB()
+	if err != nil {
+		return "", err
+	}
+	data, err := ReadDataAsJSON(db)
+	if err != nil {
+		return "", err
+	}
+	return data, nil
+}
+
+// memoryEdit is a change of a memory item in Settings > Memory, it is kept
+// until the settings are saved
+type memoryEdit struct {
+	item        UserData // as it was loaded
+	title       string
+	description string
+	value       string
+	pinned      bool
+	deleted     bool
+}
+
+func newMemoryEdit(item UserData) *memoryEdit {
+	return &memoryEdit{item: item, title: item.Title, description: item.Description, value: item.Value, pinned: item.Pinned}
+}
+
+func (e *memoryEdit) textChanged() bool {
+	return e.title != e.item.Title || e.description != e.item.Description || e.value != e.item.Value
+}
+
+func (e *memoryEdit) changed() bool {
+	return e.deleted || e.textChanged() || e.pinned != e.item.Pinned
+}
+
+// saveMemoryEdits saves the changed edits, all of them or none
+func saveMemoryEdits(edits []*memoryEdit) error {
+	for _, edit := range edits {
+		if !edit.deleted && strings.TrimSpace(edit.title) == "" {
+			return fmt.Errorf("the title of %q must not be empty", edit.item.Title)
+		}
+	}
+	return ChangeMemory(db, func(tx *gorm.DB) error {
+		for _, edit := range edits {
+			switch {
+			case edit.deleted:
+				if _, err := DeleteDataByTitle(tx, edit.item.Title); err != nil {
+					return err
+				}
+				continue
+			case edit.textChanged():
+				updates := map[string]any{"title": strings.TrimSpace(edit.title), "description": edit.description, "value": edit.value}
+				if _, err := UpdateData(tx, edit.item.Title, updates); err != nil {
+					return errors.Wrapf(err, "failed to save %q", edit.item.Title)
+				}
+			}
+			if edit.pinned != edit.item.Pinned {
+				if err := SetDataPinned(tx, edit.item.ID, edit.pinned); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSaveMemoryEdits(t *testing.T) {
+	useTestDB(t)
+	for _, title := range []string{"name", "city", "pet"} {
+		if _, err := UpsertData(db, UserData{Title: title, Value: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() map[string]UserData {
+		t.Helper()
+		items, err := ListData(db, "", -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byTitle := map[string]UserData{}
+		for _, item := range items {
+			byTitle[item.Title] = item
+		}
+		return byTitle
+	}
+	edit := func(title string) *memoryEdit {
+		return newMemoryEdit(load()[title])
+	}
+
+	// nothing is saved if one edit fails
+	rename, taken := edit("name"), edit("pet")
+	rename.value = "Anna"
+	taken.title = "city"
+	if err := saveMemoryEdits([]*memoryEdit{rename, taken}); err == nil {
+		t.Fatal("expected an error renaming to a title in use")
+	}
+	empty := edit("pet")
+	empty.title = " "
+	if err := saveMemoryEdits([]*memoryEdit{rename, empty}); err == nil {
+		t.Fatal("expected an error for an empty title")
+	}
+	if got := load()["name"].Value; got != "name" {
+		t.Fatalf("value = %q after failed saves", got)
+	}
+
+	pin, remove := edit("city"), edit("pet")
+	rename.title = " first name "
+	pin.pinned = true
+	remove.deleted = true
+	for _, e := range []*memoryEdit{rename, pin, remove} {
+		if !e.changed() {
+			t.Errorf("%s is not changed", e.item.Title)
+		}
+	}
+	if err := saveMemoryEdits([]*memoryEdit{rename, pin, remove}); err != nil {
+		t.Fatal(err)
+	}
+	items := load()
+	if len(items) != 2 || items["first name"].Value != "Anna" || !items["city"].Pinned {
+		t.Errorf("memory = %v, want first name = Anna and city pinned", items)
+	}
+	if _, ok := items["pet"]; ok {
+		t.Error("pet is not deleted")
+	}
+	if newMemoryEdit(items["city"]).changed() {
+		t.Error("a new edit is changed")
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultOpenAIBaseURL = "http://localhost:11434/v1" // default for local model servers (ollama, llama.cpp, LM Studio...)
+
+// OpenAIProvider talks to any server implementing the OpenAI chat completions API
+type OpenAIProvider struct {
+	baseURL    string
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+// NewOpenAIProvider return new OpenAI compatible provider
+func NewOpenAIProvider(baseURL string, apiKey string, model string) (*OpenAIProvider, error) {
+	if baseURL == "" {
+		baseURL = DefaultOpenAIBaseURL
+	}
+	if model == "" {
+		return nil, fmt.Errorf("model name is required for OpenAI compatible provider")
+	}
+	return &OpenAIProvider{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		model:      model,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (p *OpenAIProvider) Name() string {
+	return ProviderOpenAI
+}
+
+func (p *OpenAIProvider) StartChat(cfg ChatConfig) ChatSession {
+	return &openAIChat{p: p, cfg: cfg}
+}
+
+func (p *OpenAIProvider) Close() error {
+	p.httpClient.CloseIdleConnections()
+	return nil
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    any              `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string             `json:"type"`
+	Function openAIToolFunction `json:"function"`
+}
+
+type openAIToolFunction struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters"`
+}
+
+type openAIRequest struct {
+	Model         string          `json:"model"`
+	Messages      []openAIMessage `json:"messages"`
+	Tools         []openAITool    `json:"tools,omitempty"`
+	MaxTokens     int32           `json:"max_tokens,omitempty"`
+	Temperature   float32         `json:"temperature"`
+	Stream        bool            `json:"stream,omitempty"`
+	StreamOptions map[string]any  `json:"stream_options,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int32 `json:"prompt_tokens"`
+	CompletionTokens int32 `json:"completion_tokens"`
+	TotalTokens      int32 `json:"total_tokens"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message struct {
+			Content   string           `json:"content"`
+			ToolCalls []openAIToolCall `json:"tool_calls"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage openAIUsage `json:"usage"`
+}
+
+// openAIChunk is a single server sent event of a streamed completion
+type openAIChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+// openAIChat keeps the history as genai contents so sessions can be moved between providers
+type openAIChat struct {
+	p       *OpenAIProvider
+	cfg     ChatConfig
+	history []*genai.Content
+}
+
+func (c *openAIChat) History() []*genai.Content {
+	return c.history
+}
+
+func (c *openAIChat) SetHistory(history []*genai.Content) {
+	c.history = history
+}
+
+func (c *openAIChat) SetSystemPrompt(prompt string) {
+	c.cfg.SystemPrompt = prompt
+}
+
+func (c *openAIChat) SendMessage(ctx context.Context, parts ...genai.Part) (*Response, error) {
+	historyLen := len(c.history)
+	reqBody, err := c.request(parts, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var res openAIResponse
+	if err := c.p.post(ctx, "/chat/completions", reqBody, &res); err != nil {
+		c.history = c.history[:historyLen]
+		return nil, err
+	}
+	if len(res.Choices) == 0 {
+		c.history = c.history[:historyLen]
+		return nil, fmt.Errorf("empty response")
+	}
+
+	msg := res.Choices[0].Message
+	return c.finish(historyLen, msg.Content, msg.ToolCalls, res.Usage)
+}
+
+func (c *openAIChat) SendMessageStream(ctx context.Context, onText func(text string), parts ...genai.Part) (*Response, error) {
+	historyLen := len(c.history)
+	reqBody, err := c.request(parts, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		text  string
+		calls []openAIToolCall
+		usage openAIUsage
+	)
+	err = c.p.stream(ctx, "/chat/completions", reqBody, func(chunk *openAIChunk) {
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			return
+		}
+		delta := chunk.Choices[0].Delta
+		if delta.Content != "" {
+			text += delta.Content
+			if onText != nil {
+				onText(delta.Content)
+			}
+		}
+		// tool calls arrive in fragments, keyed by their index
+		for _, tc := range delta.ToolCalls {
+			for len(calls) <= tc.Index {
+				calls = append(calls, openAIToolCall{Type: "function"})
+			}
+			if tc.ID != "" {
+				calls[tc.Index].ID = tc.ID
+			}
+			calls[tc.Index].Function.Name += tc.Function.Name
+			calls[tc.Index].Function.Arguments += tc.Function.Arguments
+		}
+	})
+	if err != nil {
+		c.history = c.history[:historyLen]
+		return nil, err
+	}
+	return c.finish(historyLen, text, calls, usage)
+}
+
+// request appends parts to the history and builds the completion request
+func (c *openAIChat) request(parts []genai.Part, stream bool) (*openAIRequest, error) {
+	c.history = append(c.history, genai.NewUserContent(parts...))
+	messages, err := c.messages()
+	if err != nil {
+		c.history = c.history[:len(c.history)-1]
+		return nil, err
+	}
+	req := &openAIRequest{
+		Model:       c.p.model,
+		Messages:    messages,
+		Tools:       openAITools(c.cfg.Tools),
+		MaxTokens:   c.cfg.MaxOutputTokens,
+		Temperature: c.cfg.Temperature,
+		Stream:      stream,
+	}
+	if stream {
+		req.StreamOptions = map[string]any{"include_usage": true}
+	}
+	return req, nil
+}
+
+// finish converts the assistant message to a response and records it in the history
+func (c *openAIChat) finish(historyLen int, text string, toolCalls []openAIToolCall, usage openAIUsage) (*Response, error) {
+	response := &Response{
+		Usage: Usage{
+			PromptTokens: usage.PromptTokens,
+			OutputTokens: usage.CompletionTokens,
+			TotalTokens:  usage.TotalTokens,
+		},
+	}
+	if text != "" {
+		response.Parts = append(response.Parts, genai.Text(text))
+	}
+	for _, call := range toolCalls {
+		args := map[string]any{}
+		if call.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+				c.history = c.history[:historyLen]
+				return nil, fmt.Errorf("invalid arguments for %s: %v", call.Function.Name, err)
+			}
+		}
+		response.Parts = append(response.Parts, genai.FunctionCall{Name: call.Function.Name, Args: args})
+	}
+	if len(response.Parts) == 0 {
+		c.history = c.history[:historyLen]
+		return nil, fmt.Errorf("empty response")
+	}
+
+	c.history = append(c.history, &genai.Content{Role: "model", Parts: response.Parts})
+	return response, nil
+}
+
+// messages converts the genai history to chat completion messages.
+// Tool call ids are generated from the position in the history and function
+// responses are matched to the calls of the preceding model turn by name.
+func (c *openAIChat) messages() ([]openAIMessage, error) {
+	var messages []openAIMessage
+	if c.cfg.SystemPrompt != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: c.cfg.SystemPrompt})
+	}
+
+	var pending []openAIToolCall
+	for i, content := range c.history {
+		if content.Role == "model" {
+			msg := openAIMessage{Role: "assistant"}
+			var text string
+			pending = nil
+			for j, part := range content.Parts {
+				switch p := part.(type) {
+				case genai.Text:
+					text += string(p)
+				case genai.FunctionCall:
+					args, err := json.Marshal(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					call := openAIToolCall{ID: fmt.Sprintf("call_%d_%d", i, j), Type: "function"}
+					call.Function.Name = p.Name
+					call.Function.Arguments = string(args)
+					msg.ToolCalls = append(msg.ToolCalls, call)
+				}
+			}
+			if text != "" || len(msg.ToolCalls) == 0 {
+				msg.Content = text
+			}
+			pending = msg.ToolCalls
+			messages = append(messages, msg)
+			continue
+		}
+
+		var userParts []openAIContentPart
+		for _, part := range content.Parts {
+			switch p := part.(type) {
+			case genai.Text:
+				userParts = append(userParts, openAIContentPart{Type: "text", Text: string(p)})
+			case genai.Blob:
+				if !strings.HasPrefix(p.MIMEType, "image/") {
+					return nil, fmt.Errorf("attachment type %s is not supported by this provider", p.MIMEType)
+				}
+				url := "data:" + p.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(p.Data)
+				userParts = append(userParts, openAIContentPart{Type: "image_url", ImageURL: &openAIImageURL{URL: url}})
+			case genai.FileData:
+				userParts = append(userParts, openAIContentPart{Type: "text", Text: fmt.Sprintf("[uploaded %s file is not available with this provider]", p.MIMEType)})
+			case genai.FunctionResponse:
+				result, err := json.Marshal(p.Response)
+				if err != nil {
+					return nil, err
+				}
+				var id string
+				id, pending = takeToolCallID(pending, p.Name)
+				messages = append(messages, openAIMessage{Role: "tool", ToolCallID: id, Content: string(result)})
+			default:
+				return nil, fmt.Errorf("message part %T is not supported by this provider", part)
+			}
+		}
+		if len(userParts) > 0 {
+			messages = append(messages, openAIMessage{Role: "user", Content: userParts})
+		}
+	}
+	return messages, nil
+}
+
+// takeToolCallID returns the id of the first pending call named name,
+// or of the first pending call if there is no such call
+func takeToolCallID(pending []openAIToolCall, name string) (string, []openAIToolCall) {
+	if len(pending) == 0 {
+		return "", pending
+	}
+	idx := 0
+	for i, call := range pending {
+		if call.Function.Name == name {
+			idx = i
+			break
+		}
+	}
+	id := pending[idx].ID
+	rest := append(append([]openAIToolCall{}, pending[:idx]...), pending[idx+1:]...)
+	return id, rest
+}
+
+func (p *OpenAIProvider) post(ctx context.Context, path string, body any, out any) error {
+	resp, err := p.do(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// stream posts body and calls onChunk for every server sent event until [DONE]
+func (p *OpenAIProvider) stream(ctx context.Context, path string, body any, onChunk func(chunk *openAIChunk)) error {
+	resp, err := p.do(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk openAIChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("invalid stream chunk: %v", err)
+		}
+		onChunk(&chunk)
+	}
+	return scanner.Err()
+}
+
+func (p *OpenAIProvider) do(ctx context.Context, path string, body any) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return resp, nil
+}
+
+// openAITools converts genai function declarations to chat completion tools
+func openAITools(tools []*genai.Tool) []openAITool {
+	var out []openAITool
+	for _, tool := range tools {
+		for _, decl := range tool.FunctionDeclarations {
+			params := jsonSchema(decl.Parameters)
+			if params == nil {
+				params = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			out = append(out, openAITool{
+				Type: "function",
+				Function: openAIToolFunction{
+					Name:        decl.Name,
+					Description: decl.Description,
+					Parameters:  params,
+				},
+			})
+		}
+	}
+	return out
+}
+
+// jsonSchema converts a genai schema to a JSON schema object
+func jsonSchema(s *genai.Schema) map[string]any {
+	if s == nil {
+		return nil
+	}
+	out := map[string]any{}
+	switch s.Type {
+	case genai.TypeString:
+		out["type"] = "string"
+	case genai.TypeNumber:
+		out["type"] = "number"
+	case genai.TypeInteger:
+		out["type"] = "integer"
+	case genai.TypeBoolean:
+		out["type"] = "boolean"
+	case genai.TypeArray:
+		out["type"] = "array"
+	case genai.TypeObject:
+		out["type"] = "object"
+	}
+	if s.Description != "" {
+		out["description"] = s.Description
+	}
+	if len(s.Enum) > 0 {
+		out["enum"] = s.Enum
+	}
+	if s.Items != nil {
+		out["items"] = jsonSchema(s.Items)
+	}
+	if s.Type == genai.TypeObject {
+		props := map[string]any{}
+		for name, prop := range s.Properties {
+			props[name] = jsonSchema(prop)
+		}
+		out["properties"] = props
+	}
+	if len(s.Required) > 0 {
+		out["required"] = s.Required
+	}
+	return out
+}
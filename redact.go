@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"math"
+	"strings"
+)
+
+// windowInfo describes a window on screen
+type windowInfo struct {
+	App    string          // the app or executable name
+	Title  string          // the window title
+	Bounds image.Rectangle // in screen coordinates
+}
+
+// RedactionSettings decide what is blacked out of screenshots before anyone
+// sees them. Text like emails or card numbers can't be found without OCR,
+// the user masks it in the review instead.
+type RedactionSettings struct {
+	Regions []image.Rectangle // screen areas, in screen coordinates
+	Windows []string          // app names or parts of window titles, matched ignoring case
+	Review  bool              // show screenshots for masking and approval before they are sent
+}
+
+// loadRedactionSettings returns the redaction settings, screenshots are
+// reviewed unless the user turned it off
+func loadRedactionSettings() RedactionSettings {
+	settings := RedactionSettings{Review: GetSetting(db, "screenshot_review", "true") == "true"}
+	if err := json.Unmarshal([]byte(GetSetting(db, "redact_regions", "[]")), &settings.Regions); err != nil {
+		log.Println("Error reading redacted regions:", err)
+	}
+	if err := json.Unmarshal([]byte(GetSetting(db, "redact_windows", "[]")), &settings.Windows); err != nil {
+		log.Println("Error reading redacted windows:", err)
+	}
+	return settings
+}
+
+func saveRedactionSettings(settings RedactionSettings) error {
+	regions, err := json.Marshal(settings.Regions)
+	if err != nil {
+		return err
+	}
+	windows, err := json.Marshal(settings.Windows)
+	if err != nil {
+		return err
+	}
+	if err := SaveSetting(db, "redact_regions", string(regions)); err != nil {
+		return err
+	}
+	if err := SaveSetting(db, "redact_windows", string(windows)); err != nil {
+		return err
+	}
+	return SaveSetting(db, "screenshot_review", fmt.Sprint(settings.Review))
+}
+
+// redactCapture blacks out the configured regions and windows of a capture
+// of the screen area. When windows should be hidden but can't be listed the
+// capture is refused rather than sent with them.
+func redactCapture(img *image.RGBA, screen image.Rectangle, settings RedactionSettings) error {
+	if screen.Empty() {
+		return nil
+	}
+	masks := settings.Regions
+	if len(settings.Windows) > 0 {
+		windows, err := visibleWindows()
+		if err != nil {
+			return fmt.Errorf("could not find the windows to hide: %v", err)
+		}
+		for _, window := range windows {
+			if windowExcluded(window, settings.Windows) {
+				masks = append(masks[:len(masks):len(masks)], window.Bounds)
+			}
+		}
+	}
+
+	scaleX := float64(img.Bounds().Dx()) / float64(screen.Dx())
+	scaleY := float64(img.Bounds().Dy()) / float64(screen.Dy())
+	masked := 0
+	for _, mask := range masks {
+		mask = mask.Intersect(screen)
+		if mask.Empty() {
+			continue
+		}
+		// round outwards so no edge of the area is left
+		rect := image.Rect(
+			int(math.Floor(float64(mask.Min.X-screen.Min.X)*scaleX)),
+			int(math.Floor(float64(mask.Min.Y-screen.Min.Y)*scaleY)),
+			int(math.Ceil(float64(mask.Max.X-screen.Min.X)*scaleX)),
+			int(math.Ceil(float64(mask.Max.Y-screen.Min.Y)*scaleY)),
+		).Add(img.Bounds().Min)
+		maskRect(img, rect)
+		masked++
+	}
+	if masked > 0 {
+		log.Println("Redacted", masked, "areas of the screenshot")
+	}
+	return nil
+}
+
+// windowExcluded reports whether a window matches one of the names. Names
+// match any part of the app name or title, hiding too much is the safe side.
+func windowExcluded(window windowInfo, names []string) bool {
+	app := strings.ToLower(window.App)
+	title := strings.ToLower(window.Title)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && (strings.Contains(app, name) || strings.Contains(title, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskRect blacks out rect of img
+func maskRect(img draw.Image, rect image.Rectangle) {
+	draw.Draw(img, rect.Intersect(img.Bounds()), image.Black, image.Point{}, draw.Src)
+}
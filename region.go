@@ -0,0 +1,195 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// regionSelector returns a RegionSelector which shows the capture full screen
+// and lets the user drag a rectangle over it, hint tells what for. It blocks
+// until the user is done, so it must not be called from the UI thread.
+func regionSelector(a fyne.App, hint string) RegionSelector {
+	return func(img *image.RGBA) (image.Rectangle, bool) {
+		type selection struct {
+			rect image.Rectangle
+			ok   bool
+		}
+		result := make(chan selection, 1)
+		var once sync.Once
+		window := a.NewWindow("Select a region")
+		finish := func(rect image.Rectangle, ok bool) {
+			first := false
+			once.Do(func() {
+				result <- selection{rect, ok}
+				first = true
+			})
+			if first {
+				window.Close()
+			}
+		}
+
+		window.SetContent(newRegionOverlay(img, hint, func(rect image.Rectangle) {
+			finish(rect, true)
+		}))
+		window.Canvas().SetOnTypedKey(func(key *fyne.KeyEvent) {
+			if key.Name == fyne.KeyEscape {
+				finish(image.Rectangle{}, false)
+			}
+		})
+		window.SetOnClosed(func() {
+			finish(image.Rectangle{}, false)
+		})
+		window.SetFullScreen(true)
+		window.Show()
+
+		selected := <-result
+		return selected.rect, selected.ok
+	}
+}
+
+// screenshotReviewer returns a ScreenshotReviewer which shows the capture in
+// a window where the user can black out areas before it is sent. It blocks
+// until the user is done, so it must not be called from the UI thread.
+func screenshotReviewer(a fyne.App) ScreenshotReviewer {
+	return func(img *image.RGBA) (*image.RGBA, bool) {
+		reviewed := image.NewRGBA(img.Bounds())
+		draw.Draw(reviewed, reviewed.Bounds(), img, img.Bounds().Min, draw.Src)
+
+		result := make(chan bool, 1)
+		var once sync.Once
+		window := a.NewWindow("Review screenshot")
+		finish := func(ok bool) {
+			first := false
+			once.Do(func() {
+				result <- ok
+				first = true
+			})
+			if first {
+				window.Close()
+			}
+		}
+
+		var overlay *regionOverlay
+		overlay = newRegionOverlay(reviewed, "Drag over anything that should not be sent to black it out", func(rect image.Rectangle) {
+			maskRect(reviewed, rect)
+			overlay.image.Refresh()
+		})
+		clearButton := widget.NewButtonWithIcon("Clear masks", theme.ContentUndoIcon(), func() {
+			draw.Draw(reviewed, reviewed.Bounds(), img, img.Bounds().Min, draw.Src)
+			overlay.image.Refresh()
+		})
+		cancelButton := widget.NewButtonWithIcon("Don't send", theme.CancelIcon(), func() {
+			finish(false)
+		})
+		sendButton := widget.NewButtonWithIcon("Send", theme.MailSendIcon(), func() {
+			finish(true)
+		})
+		sendButton.Importance = widget.HighImportance
+
+		window.SetContent(container.NewBorder(nil, container.NewHBox(clearButton, layout.NewSpacer(), cancelButton, sendButton), nil, nil, overlay))
+		window.Canvas().SetOnTypedKey(func(key *fyne.KeyEvent) {
+			if key.Name == fyne.KeyEscape {
+				finish(false)
+			}
+		})
+		window.SetOnClosed(func() {
+			finish(false)
+		})
+		window.Resize(fyne.NewSize(960, 640))
+		window.CenterOnScreen()
+		window.Show()
+
+		return reviewed, <-result
+	}
+}
+
+// regionOverlay shows a capture fitted into the widget and reports the
+// rectangles the user drags, in pixels of the capture
+type regionOverlay struct {
+	widget.BaseWidget
+	img       *image.RGBA
+	image     *canvas.Image
+	selection *canvas.Rectangle
+	hint      *widget.Label
+	start     fyne.Position
+	dragging  bool
+	onSelect  func(rect image.Rectangle)
+}
+
+func newRegionOverlay(img *image.RGBA, hint string, onSelect func(rect image.Rectangle)) *regionOverlay {
+	o := &regionOverlay{img: img, onSelect: onSelect}
+	o.image = canvas.NewImageFromImage(img)
+	o.image.FillMode = canvas.ImageFillContain
+	o.selection = canvas.NewRectangle(color.NRGBA{R: 0x33, G: 0x99, B: 0xff, A: 0x40})
+	o.selection.StrokeColor = color.NRGBA{R: 0x33, G: 0x99, B: 0xff, A: 0xff}
+	o.selection.StrokeWidth = 2
+	o.selection.Hide()
+	o.hint = widget.NewLabel(hint)
+	o.ExtendBaseWidget(o)
+	return o
+}
+
+func (o *regionOverlay) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(container.NewStack(
+		o.image,
+		container.NewWithoutLayout(o.selection),
+		container.NewVBox(container.NewCenter(o.hint)),
+	))
+}
+
+func (o *regionOverlay) Dragged(event *fyne.DragEvent) {
+	if !o.dragging {
+		o.dragging = true
+		o.start = event.Position.Subtract(event.Dragged)
+		o.hint.Hide()
+		o.selection.Show()
+	}
+	topLeft := fyne.NewPos(min(o.start.X, event.Position.X), min(o.start.Y, event.Position.Y))
+	o.selection.Move(topLeft)
+	o.selection.Resize(fyne.NewSize(abs32(event.Position.X-o.start.X), abs32(event.Position.Y-o.start.Y)))
+	o.selection.Refresh()
+}
+
+func (o *regionOverlay) DragEnd() {
+	if !o.dragging {
+		return
+	}
+	o.dragging = false
+	o.selection.Hide()
+	size := o.Size()
+	bounds := o.img.Bounds()
+	if size.Width <= 0 || size.Height <= 0 || bounds.Empty() {
+		return
+	}
+	// the image keeps its aspect ratio and is centered
+	scale := min(size.Width/float32(bounds.Dx()), size.Height/float32(bounds.Dy()))
+	offset := fyne.NewPos((size.Width-float32(bounds.Dx())*scale)/2, (size.Height-float32(bounds.Dy())*scale)/2)
+	toPixels := func(pos fyne.Position) image.Point {
+		pos = pos.Subtract(offset)
+		return image.Pt(bounds.Min.X+int(pos.X/scale), bounds.Min.Y+int(pos.Y/scale))
+	}
+	pos := o.selection.Position()
+	rect := image.Rectangle{Min: toPixels(pos), Max: toPixels(pos.Add(o.selection.Size()))}.Canon().Intersect(bounds)
+	if rect.Dx() < 4 || rect.Dy() < 4 {
+		// a click, not a selection
+		o.hint.Show()
+		return
+	}
+	o.onSelect(rect)
+}
+
+func abs32(v float32) float32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -2,40 +2,248 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/kbinani/screenshot"
+	xdraw "golang.org/x/image/draw"
+	"image"
+	"image/draw"
+	"image/jpeg"
 	"image/png"
 	"log"
 	"os"
+	"strconv"
 )
 
-func captureScreen() ([]byte, error) {
+// Screen capture modes, stored in the capture_mode setting
+const (
+	CaptureDisplay = "display" // the display of the capture_display setting
+	CaptureAll     = "all"     // all displays stitched into one image
+	CaptureWindow  = "window"  // the active window
+	CaptureRegion  = "region"  // a region the user selects on all displays
+)
+
+// errCaptureCancelled is returned when the user cancels the region selection
+// or the review
+var errCaptureCancelled = errors.New("screenshot cancelled")
+
+// RegionSelector lets the user select a region of a capture, ok is false if
+// the selection was cancelled
+type RegionSelector func(img *image.RGBA) (rect image.Rectangle, ok bool)
+
+// ScreenshotReviewer shows a capture to the user, who may mask parts of it,
+// ok is false if the user doesn't want it sent
+type ScreenshotReviewer func(img *image.RGBA) (reviewed *image.RGBA, ok bool)
+
+// CaptureUI lets the user take part in a capture. Without it the region mode
+// captures all displays and screenshots are sent without review.
+type CaptureUI struct {
+	SelectRegion RegionSelector
+	Review       ScreenshotReviewer
+}
+
+// captureSettings returns the capture mode and display chosen in settings
+func captureSettings() (mode string, display int) {
+	mode = GetSetting(db, "capture_mode", CaptureDisplay)
+	display, err := strconv.Atoi(GetSetting(db, "capture_display", "0"))
+	if err != nil || display < 0 {
+		display = 0
+	}
+	return mode, display
+}
+
+// Screenshot formats, WebP is not offered as Go has no WebP encoder
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+)
+
+// ScreenshotOptions control how captures are encoded before they are sent
+type ScreenshotOptions struct {
+	MaxDimension int    // longer side in pixels, 0 keeps the native resolution
+	Format       string // FormatPNG or FormatJPEG
+	Quality      int    // JPEG quality, 1-100
+	Grayscale    bool
+}
+
+// loadScreenshotOptions returns the screenshot options from settings
+func loadScreenshotOptions() ScreenshotOptions {
+	opts := ScreenshotOptions{MaxDimension: 2048, Format: FormatPNG, Quality: 80}
+	if n, err := strconv.Atoi(GetSetting(db, "screenshot_max_dimension", "")); err == nil && n >= 0 {
+		opts.MaxDimension = n
+	}
+	if format := GetSetting(db, "screenshot_format", ""); format == FormatJPEG || format == FormatPNG {
+		opts.Format = format
+	}
+	if n, err := strconv.Atoi(GetSetting(db, "screenshot_quality", "")); err == nil && n >= 1 && n <= 100 {
+		opts.Quality = n
+	}
+	opts.Grayscale = GetSetting(db, "screenshot_grayscale", "") == "true"
+	return opts
+}
+
+// captureScreen captures the screen as chosen in settings, redacts it and
+// encodes it with the screenshot options. ui may be nil.
+func captureScreen(ui *CaptureUI) (data []byte, format string, err error) {
 	log.Println("capturing screen")
+	mode, display := captureSettings()
+	var selectRegion RegionSelector
+	if ui != nil {
+		selectRegion = ui.SelectRegion
+	}
+	img, err := captureImage(mode, display, selectRegion)
+	if err != nil {
+		return nil, "", err
+	}
+	if ui != nil && ui.Review != nil && loadRedactionSettings().Review {
+		reviewed, ok := ui.Review(img)
+		if !ok {
+			return nil, "", errCaptureCancelled
+		}
+		img = reviewed
+	}
+
+	opts := loadScreenshotOptions()
+	data, err = encodeScreenshot(img, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("Screenshot %dx%d encoded as %s: %s", img.Bounds().Dx(), img.Bounds().Dy(), opts.Format, formatSize(len(data)))
+
+	if DEVFLAG {
+		if err := os.WriteFile("test."+opts.Format, data, 0644); err != nil {
+			log.Println("Error creating file:", err)
+		}
+	}
+
+	return data, opts.Format, nil
+}
+
+// encodeScreenshot downscales, converts and encodes a capture
+func encodeScreenshot(img image.Image, opts ScreenshotOptions) ([]byte, error) {
+	bounds := img.Bounds()
+	if longest := max(bounds.Dx(), bounds.Dy()); opts.MaxDimension > 0 && longest > opts.MaxDimension {
+		scale := float64(opts.MaxDimension) / float64(longest)
+		dst := image.NewRGBA(image.Rect(0, 0, max(int(float64(bounds.Dx())*scale), 1), max(int(float64(bounds.Dy())*scale), 1)))
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+		img = dst
+	}
+	if opts.Grayscale {
+		gray := image.NewGray(img.Bounds())
+		draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = gray
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if opts.Format == FormatJPEG {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: opts.Quality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// formatSize returns a byte count for people
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%d KB", n>>10)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// captureImage captures the screen in the given mode and blacks out the
+// areas hidden in the redaction settings
+func captureImage(mode string, display int, selectRegion RegionSelector) (*image.RGBA, error) {
 	n := screenshot.NumActiveDisplays()
 	if n <= 0 {
 		log.Println("found this many displays:", n)
 		return nil, fmt.Errorf("no active display found")
 	}
 
-	bounds := screenshot.GetDisplayBounds(0)
-	img, err := screenshot.CaptureRect(bounds)
+	var img *image.RGBA
+	var screen image.Rectangle // the captured area in screen coordinates
+	var err error
+	switch mode {
+	case CaptureAll, CaptureRegion:
+		img, screen, err = captureAllDisplays(n)
+		if err != nil {
+			return nil, err
+		}
+	case CaptureWindow:
+		screen, err = activeWindowBounds()
+		if err != nil {
+			return nil, fmt.Errorf("could not find the active window: %v", err)
+		}
+		img, err = screenshot.CaptureRect(screen)
+	default:
+		if display >= n {
+			log.Println("Display", display, "is not connected, capturing the main display")
+			display = 0
+		}
+		screen = screenshot.GetDisplayBounds(display)
+		img, err = screenshot.CaptureDisplay(display)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to capture screen: %v", err)
 	}
+	if err := redactCapture(img, screen, loadRedactionSettings()); err != nil {
+		return nil, err
+	}
 
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, img); err != nil {
-		return nil, fmt.Errorf("failed to encode image: %v", err)
+	if mode != CaptureRegion || selectRegion == nil {
+		return img, nil
 	}
+	rect, ok := selectRegion(img)
+	if !ok || rect.Intersect(img.Bounds()).Empty() {
+		return nil, errCaptureCancelled
+	}
+	return img.SubImage(rect).(*image.RGBA), nil
+}
 
-	if DEVFLAG {
-		f, err := os.Create("test.png")
+// captureAllDisplays captures every display and stitches them into one image
+// as they are arranged, screen is the area they cover. Displays are scaled
+// alike, so with mixed pixel densities the image has the resolution of the
+// densest display.
+func captureAllDisplays(n int) (*image.RGBA, image.Rectangle, error) {
+	var union image.Rectangle
+	images := make([]*image.RGBA, n)
+	scale := 1.0
+	for i := 0; i < n; i++ {
+		bounds := screenshot.GetDisplayBounds(i)
+		img, err := screenshot.CaptureDisplay(i)
 		if err != nil {
-			log.Println("Error creating file:", err)
+			return nil, image.Rectangle{}, fmt.Errorf("failed to capture display %d: %v", i+1, err)
+		}
+		images[i] = img
+		union = union.Union(bounds)
+		if bounds.Dx() > 0 {
+			scale = max(scale, float64(img.Bounds().Dx())/float64(bounds.Dx()))
 		}
-		defer f.Close()
-		png.Encode(f, img)
 	}
 
-	return buf.Bytes(), nil
+	scaled := func(v int) int { return int(float64(v) * scale) }
+	stitched := image.NewRGBA(image.Rect(0, 0, scaled(union.Dx()), scaled(union.Dy())))
+	for i, img := range images {
+		offset := screenshot.GetDisplayBounds(i).Min.Sub(union.Min)
+		at := image.Pt(scaled(offset.X), scaled(offset.Y))
+		draw.Draw(stitched, img.Bounds().Sub(img.Bounds().Min).Add(at), img, img.Bounds().Min, draw.Src)
+	}
+	return stitched, union, nil
+}
+
+// displayNames returns a name for every connected display
+func displayNames() []string {
+	var names []string
+	for i := 0; i < screenshot.NumActiveDisplays(); i++ {
+		bounds := screenshot.GetDisplayBounds(i)
+		names = append(names, fmt.Sprintf("Display %d (%dx%d)", i+1, bounds.Dx(), bounds.Dy()))
+	}
+	return names
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxListEntries  = 500     // entries returned by file_list and file_search
+	maxGrepMatches  = 200     // matching lines returned by file_grep
+	maxGrepFileSize = 2 << 20 // larger files are skipped by file_grep
+	maxSearchDepth  = 20      // folder levels searched by file_search and file_grep
+)
+
+var fileSearchSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"pattern": {
+			Type:        genai.TypeString,
+			Description: "Glob matched against file names, e.g. *.go or report*. With a / it is matched against the path relative to dir, e.g. src/*.go",
+		},
+		"dir": {
+			Type:        genai.TypeString,
+			Description: "The folder to search in, all workspace folders if empty",
+		},
+	},
+	Required: []string{"pattern"},
+}
+
+var fileGrepSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"query": {
+			Type:        genai.TypeString,
+			Description: "The text to search for in file contents",
+		},
+		"regex": {
+			Type:        genai.TypeBoolean,
+			Description: "Treat query as a regular expression (Go syntax)",
+		},
+		"ignoreCase": {
+			Type:        genai.TypeBoolean,
+			Description: "Match upper and lower case alike",
+		},
+		"dir": {
+			Type:        genai.TypeString,
+			Description: "The folder to search in, all workspace folders if empty",
+		},
+		"glob": {
+			Type:        genai.TypeString,
+			Description: "Only search files whose name matches this glob, e.g. *.md",
+		},
+	},
+	Required: []string{"query"},
+}
+
+type fileSearchTool struct{}
+
+func (fileSearchTool) Name() string { return "file_search" }
+
+func (fileSearchTool) Description() string {
+	return "find files and folders by name in the user's workspace folders, searching all subfolders"
+}
+
+func (fileSearchTool) Schema() *genai.Schema { return fileSearchSchema }
+
+func (fileSearchTool) ReadOnly() bool { return true }
+
+func (fileSearchTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	pattern := args["pattern"].(string)
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	dir, _ := args["dir"].(string)
+
+	var entries []any
+	truncated := false
+	err := walkWorkspace(ctx, dir, maxSearchDepth, func(base string, path string, name string, d fs.DirEntry) error {
+		match := d.Name()
+		if strings.Contains(pattern, "/") {
+			rel, _ := filepath.Rel(base, path)
+			match = filepath.ToSlash(rel)
+		}
+		if ok, _ := filepath.Match(pattern, match); !ok {
+			return nil
+		}
+		if len(entries) == maxListEntries {
+			truncated = true
+			return filepath.SkipAll
+		}
+		entries = append(entries, fileEntry(name, d))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"result": entries, "truncated": truncated}, nil
+}
+
+type fileGrepTool struct{}
+
+func (fileGrepTool) Name() string { return "file_grep" }
+
+func (fileGrepTool) Description() string {
+	return "search the contents of text files in the user's workspace folders, returns the matching lines with file and line number"
+}
+
+func (fileGrepTool) Schema() *genai.Schema { return fileGrepSchema }
+
+func (fileGrepTool) ReadOnly() bool { return true }
+
+func (fileGrepTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	query := args["query"].(string)
+	if isRegex, _ := args["regex"].(bool); !isRegex {
+		query = regexp.QuoteMeta(query)
+	}
+	if ignoreCase, _ := args["ignoreCase"].(bool); ignoreCase {
+		query = "(?i)" + query
+	}
+	re, err := regexp.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %v", err)
+	}
+	glob, _ := args["glob"].(string)
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob: %v", err)
+	}
+	dir, _ := args["dir"].(string)
+
+	var matches []any
+	truncated := false
+	err = walkWorkspace(ctx, dir, maxSearchDepth, func(base string, path string, name string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if ok, _ := filepath.Match(glob, d.Name()); glob != "" && !ok {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > maxGrepFileSize {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || isBinary(data) {
+			return nil
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			if !re.MatchString(line) {
+				continue
+			}
+			if len(matches) == maxGrepMatches {
+				truncated = true
+				return filepath.SkipAll
+			}
+			matches = append(matches, map[string]any{
+				"file": name,
+				"line": i + 1,
+				"text": strings.TrimRight(previewText(line), "\r"),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"result": matches, "truncated": truncated}, nil
+}
+
+// walkWorkspace calls fn for every entry below dir, or below every workspace
+// root when dir is empty, up to depth folder levels deep. name is the
+// workspaceName of path. Hidden files and folders are skipped and symlinks
+// are not followed. fn may return filepath.SkipAll to stop.
+func walkWorkspace(ctx context.Context, dir string, depth int, fn func(base string, path string, name string, d fs.DirEntry) error) error {
+	roots := resolvedRoots()
+	bases := roots
+	if dir != "" {
+		path, err := resolvePath(dir)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return &ToolError{Code: ErrCodeNotFound, Message: "folder " + dir + " does not exist"}
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return &ToolError{Code: ErrCodeInvalidPath, Message: dir + " is not a folder"}
+		}
+		bases = []string{path}
+	}
+
+	for _, base := range bases {
+		err := filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err != nil || path == base {
+				// unreadable entries are skipped
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if err := fn(base, path, workspaceName(roots, path), d); err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(base, path)
+			if d.IsDir() && strings.Count(rel, string(filepath.Separator))+1 >= depth {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err == filepath.SkipAll {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileEntry describes a file for the model, name is its workspaceName
+func fileEntry(name string, d fs.DirEntry) map[string]any {
+	entry := map[string]any{"name": name, "is_dir": d.IsDir()}
+	if info, err := d.Info(); err == nil {
+		entry["mtime"] = info.ModTime().Format("2006-01-02 15:04:05")
+		if !d.IsDir() {
+			entry["size"] = info.Size()
+		}
+	}
+	return entry
+}
+
+// workspaceName returns the name the model should use for a path: relative
+// to the first of the resolved workspace roots if it is inside it, absolute
+// otherwise
+func workspaceName(roots []string, path string) string {
+	if len(roots) > 0 && isWithin(path, roots[0]) {
+		if rel, err := filepath.Rel(roots[0], path); err == nil {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return path
+}
+
+// isBinary reports whether data looks like a binary file
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0
+}
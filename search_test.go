@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// entryNames returns the sorted names of file_list and file_search results
+func entryNames(entries []any) []string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.(map[string]any)["name"].(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWorkspaceSearch(t *testing.T) {
+	root := useTestWorkspace(t)
+	extra, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveWorkspaceRoots([]string{root, extra}); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		"a.txt":          "hello\n",
+		"sub/b.go":       "package b\n// hello\n",
+		"sub/deep/c.txt": "bye\n",
+		".hidden/d.txt":  "hello\n",
+	} {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(extra, "e.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	entries, _, err := ListWorkspaceFiles(ctx, "", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// names outside the first root are absolute
+	if got, want := entryNames(entries), []string{filepath.Join(extra, "e.txt"), "a.txt", "sub"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("file_list = %v, want %v", got, want)
+	}
+
+	result, err := fileSearchTool{}.Invoke(ctx, map[string]any{"pattern": "*.txt", "dir": "sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entryNames(result["result"].([]any)), []string{"sub/deep/c.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("file_search = %v, want %v", got, want)
+	}
+
+	result, err = fileGrepTool{}.Invoke(ctx, map[string]any{"query": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, match := range result["result"].([]any) {
+		files = append(files, match.(map[string]any)["file"].(string))
+	}
+	sort.Strings(files)
+	if want := []string{filepath.Join(extra, "e.txt"), "a.txt", "sub/b.go"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("file_grep files = %v, want %v", files, want)
+	}
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kbinani/screenshot"
+	"image"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+func showSettingsDialog(app *App, window fyne.Window, onSave func(cfg ProviderConfig)) {
+	general, saveGeneral := generalSettings(app, window, onSave)
+	tools, saveTools := toolSettings()
+	files, saveFiles := fileSettings(window)
+	screen, saveScreen := screenSettings(window)
+	memory, saveMemory := memorySettings(window)
+
+	tabs := container.NewAppTabs(
+		container.NewTabItem("General", container.NewVScroll(general)),
+		container.NewTabItem("Memory", memory),
+		container.NewTabItem("Tools", container.NewVScroll(tools)),
+		container.NewTabItem("Files", container.NewVScroll(files)),
+		container.NewTabItem("Screen", container.NewVScroll(screen)),
+	)
+	var d *dialog.ConfirmDialog
+	d = dialog.NewCustomConfirm("Settings", "Save", "Cancel", tabs, func(save bool) {
+		if !save {
+			return
+		}
+		// nothing is saved until the provider settings are valid
+		if err := saveGeneral(); err != nil {
+			errorDialog := dialog.NewError(err, window)
+			errorDialog.SetOnClosed(d.Show)
+			errorDialog.Show()
+			return
+		}
+		if err := saveMemory(); err != nil {
+			errorDialog := dialog.NewError(err, window)
+			errorDialog.SetOnClosed(d.Show)
+			errorDialog.Show()
+			return
+		}
+		saveTools()
+		saveFiles()
+		saveScreen()
+	}, window)
+	d.Resize(fyne.NewSize(520, 600))
+	d.Show()
+}
+
+// generalSettings returns the provider settings and a function saving them,
+// which saves nothing and returns an error if the provider settings are invalid
+func generalSettings(app *App, window fyne.Window, onSave func(cfg ProviderConfig)) (fyne.CanvasObject, func() error) {
+	cfg := loadProviderConfig(app.apiKey)
+
+	apiKeyEntry := widget.NewEntry()
+	apiKeyEntry.SetText(cfg.APIKey)
+	baseURLEntry := widget.NewEntry()
+	baseURLEntry.SetPlaceHolder(DefaultOpenAIBaseURL)
+	baseURLEntry.SetText(cfg.BaseURL)
+	modelEntry := widget.NewEntry()
+	modelEntry.SetText(cfg.Model)
+
+	providerSelect := widget.NewSelect([]string{ProviderGemini, ProviderOpenAI}, func(kind string) {
+		selected := loadProviderConfig(app.apiKey)
+		if kind != cfg.Kind {
+			selected = ProviderConfig{Kind: kind, APIKey: providerAPIKey(kind, app.apiKey), Model: GetSetting(db, kind+"_model", "")}
+		}
+		apiKeyEntry.SetText(selected.APIKey)
+		modelEntry.SetText(selected.Model)
+		if kind == ProviderOpenAI {
+			baseURLEntry.Enable()
+		} else {
+			baseURLEntry.Disable()
+		}
+	})
+	providerSelect.SetSelected(cfg.Kind)
+
+	maxToolRounds := loadMaxToolRounds()
+	maxToolRoundsEntry := widget.NewEntry()
+	maxToolRoundsEntry.SetText(strconv.Itoa(maxToolRounds))
+
+	content := container.NewVBox(
+		widget.NewLabel("Provider:"),
+		providerSelect,
+		widget.NewLabel("API Key:"),
+		apiKeyEntry,
+		widget.NewLabel("Model:"),
+		modelEntry,
+		widget.NewLabel("Server URL (OpenAI compatible):"),
+		baseURLEntry,
+		widget.NewLabel("Max tool rounds per message:"),
+		maxToolRoundsEntry,
+		widget.NewLabel("Version: "+VERSION),
+		widget.NewLabel("pilsnerbeer/the_eye_chatbot"),
+	)
+
+	return content, func() error {
+		newcfg := ProviderConfig{
+			Kind:    providerSelect.Selected,
+			APIKey:  strings.TrimSpace(apiKeyEntry.Text),
+			BaseURL: strings.TrimSpace(baseURLEntry.Text),
+			Model:   strings.TrimSpace(modelEntry.Text),
+		}
+		if newcfg.Kind != ProviderOpenAI {
+			newcfg.BaseURL = cfg.BaseURL
+		}
+		if err := validateProviderConfig(newcfg); err != nil {
+			return err
+		}
+
+		rounds, err := strconv.Atoi(maxToolRoundsEntry.Text)
+		if err == nil && rounds > 0 && rounds != maxToolRounds {
+			// used from the next message on
+			if err := SaveSetting(db, "max_tool_rounds", strconv.Itoa(rounds)); err != nil {
+				log.Println("Error saving max tool rounds:", err)
+			}
+		}
+
+		if newcfg != cfg {
+			err := saveProviderConfig(newcfg)
+			if err != nil {
+				log.Println("Error saving provider settings:", err)
+				return nil
+			}
+			if newcfg.Kind == ProviderGemini {
+				app.apiKey = newcfg.APIKey
+			}
+			onSave(loadProviderConfig(app.apiKey))
+		}
+		return nil
+	}
+}
+
+// maxMemoryRows is how many memory items the memory settings show at once
+const maxMemoryRows = 100
+
+// memorySettings lets the user search, edit, pin, delete, import and export
+// memory items. Edits, pins and deletions are kept until the returned
+// function saves them with the embedding settings, import and clear are
+// saved right away.
+func memorySettings(window fyne.Window) (fyne.CanvasObject, func() error) {
+	countLabel := widget.NewLabel("")
+	searchEntry := widget.NewEntry()
+	searchEntry.SetPlaceHolder("Search memory")
+	rows := container.NewVBox()
+
+	// edits by item ID, rows show them until the settings are saved
+	edits := map[uint]*memoryEdit{}
+	var refresh func()
+	refresh = func() {
+		rows.RemoveAll()
+		count, err := CountRows(db)
+		if err != nil {
+			log.Println("Error counting memory items:", err)
+		}
+		countLabel.SetText(fmt.Sprintf("Items stored in memory: %d", count))
+		items, err := ListData(db, strings.TrimSpace(searchEntry.Text), maxMemoryRows)
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		if len(items) == 0 {
+			rows.Add(widget.NewLabel("Nothing found"))
+		}
+		for _, item := range items {
+			edit, ok := edits[item.ID]
+			if !ok || !edit.changed() {
+				edit = newMemoryEdit(item)
+				edits[item.ID] = edit
+			}
+			rows.Add(memoryRow(edit))
+		}
+		if len(items) == maxMemoryRows {
+			rows.Add(widget.NewLabel(fmt.Sprintf("Showing the first %d items, search to find others", maxMemoryRows)))
+		}
+	}
+	searchEntry.OnChanged = func(string) { refresh() }
+	refresh()
+
+	exportButton := widget.NewButtonWithIcon("Export", theme.DocumentSaveIcon(), func() {
+		dialog.ShowFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil || writer == nil {
+				return
+			}
+			defer writer.Close()
+			items, err := ListData(db, "", -1)
+			if err == nil {
+				var data []byte
+				data, err = json.MarshalIndent(items, "", "  ")
+				if err == nil {
+					_, err = writer.Write(data)
+				}
+			}
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("failed to export memory: %v", err), window)
+			}
+		}, window)
+	})
+	importButton := widget.NewButtonWithIcon("Import", theme.FolderOpenIcon(), func() {
+		open := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			defer reader.Close()
+			var items []UserData
+			if err := json.NewDecoder(reader).Decode(&items); err != nil {
+				dialog.ShowError(fmt.Errorf("not a memory export: %v", err), window)
+				return
+			}
+			for i := range items {
+				items[i].Title = strings.TrimSpace(items[i].Title)
+				if items[i].Title == "" {
+					dialog.ShowError(fmt.Errorf("item %d of the file has no title", i+1), window)
+					return
+				}
+			}
+			replaced, err := ImportData(db, items)
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			refresh()
+			dialog.ShowInformation("Memory imported", fmt.Sprintf("Imported %d items, %d of them replaced items with the same title", len(items), replaced), window)
+		}, window)
+		open.SetFilter(storage.NewExtensionFileFilter([]string{".json"}))
+		open.Show()
+	})
+	clearButton := widget.NewButtonWithIcon("Clear memory", theme.DeleteIcon(), func() {
+		dialog.ShowConfirm("Clear memory", "Delete everything stored in memory?", func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := DeleteData(db); err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			clear(edits)
+			refresh()
+		}, window)
+	})
+
+	modes := []string{EmbeddingsProvider, EmbeddingsLocal, EmbeddingsOff}
+	modeNames := []string{"Provider's embedding model", "Local (only similar words)", "Off (keywords only)"}
+	mode := GetSetting(db, "memory_embeddings", EmbeddingsProvider)
+	modeSelect := widget.NewSelect(modeNames, nil)
+	modeSelect.SetSelectedIndex(max(slices.Index(modes, mode), 0))
+	embeddingModel := GetSetting(db, "openai_embedding_model", "")
+	embeddingModelEntry := widget.NewEntry()
+	embeddingModelEntry.SetPlaceHolder("e.g. nomic-embed-text, empty for local")
+	embeddingModelEntry.SetText(embeddingModel)
+	summarize := summaryEnabled()
+	summarizeCheck := widget.NewCheck("Offer to remember facts when a conversation ends", nil)
+	summarizeCheck.SetChecked(summarize)
+
+	top := container.NewVBox(
+		widget.NewLabel("Find memory related in meaning with:"),
+		modeSelect,
+		widget.NewLabel("Embedding model (OpenAI compatible):"),
+		embeddingModelEntry,
+		summarizeCheck,
+		widget.NewSeparator(),
+		countLabel,
+		searchEntry,
+		container.NewHBox(importButton, exportButton, layout.NewSpacer(), clearButton),
+	)
+	return container.NewBorder(top, nil, nil, nil, container.NewVScroll(rows)), func() error {
+		var changed []*memoryEdit
+		for _, edit := range edits {
+			if edit.changed() {
+				changed = append(changed, edit)
+			}
+		}
+		if err := saveMemoryEdits(changed); err != nil {
+			return err
+		}
+		clear(edits)
+
+		if newMode := modes[modeSelect.SelectedIndex()]; newMode != mode {
+			if err := SaveSetting(db, "memory_embeddings", newMode); err != nil {
+				log.Println("Error saving memory embeddings:", err)
+			}
+		}
+		if newModel := strings.TrimSpace(embeddingModelEntry.Text); newModel != embeddingModel {
+			if err := SaveSetting(db, "openai_embedding_model", newModel); err != nil {
+				log.Println("Error saving embedding model:", err)
+			}
+		}
+		if summarizeCheck.Checked != summarize {
+			if err := SaveSetting(db, "memory_summarize", fmt.Sprint(summarizeCheck.Checked)); err != nil {
+				log.Println("Error saving memory summarize:", err)
+			}
+		}
+		return nil
+	}
+}
+
+// memoryRow shows a memory item for editing, changes are kept in edit
+func memoryRow(edit *memoryEdit) fyne.CanvasObject {
+	titleEntry := widget.NewEntry()
+	titleEntry.SetText(edit.title)
+	titleEntry.SetPlaceHolder("Title")
+	titleEntry.OnChanged = func(text string) { edit.title = text }
+	descriptionEntry := widget.NewEntry()
+	descriptionEntry.SetText(edit.description)
+	descriptionEntry.SetPlaceHolder("Description")
+	descriptionEntry.OnChanged = func(text string) { edit.description = text }
+	valueEntry := widget.NewMultiLineEntry()
+	valueEntry.SetText(edit.value)
+	valueEntry.SetPlaceHolder("Value")
+	valueEntry.Wrapping = fyne.TextWrapWord
+	valueEntry.OnChanged = func(text string) { edit.value = text }
+
+	pinCheck := widget.NewCheck("Pinned", func(pinned bool) { edit.pinned = pinned })
+	pinCheck.Checked = edit.pinned
+
+	var deleteButton *widget.Button
+	showDeleted := func() {
+		if edit.deleted {
+			titleEntry.Disable()
+			descriptionEntry.Disable()
+			valueEntry.Disable()
+			pinCheck.Disable()
+			deleteButton.SetIcon(theme.ContentUndoIcon())
+		} else {
+			titleEntry.Enable()
+			descriptionEntry.Enable()
+			valueEntry.Enable()
+			pinCheck.Enable()
+			deleteButton.SetIcon(theme.DeleteIcon())
+		}
+	}
+	// deleted on save, until then it can be undone
+	deleteButton = widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+		edit.deleted = !edit.deleted
+		showDeleted()
+	})
+	showDeleted()
+
+	fields := container.NewVBox(container.NewGridWithColumns(2, titleEntry, descriptionEntry), valueEntry)
+	return container.NewVBox(
+		container.NewBorder(nil, nil, nil, container.NewHBox(pinCheck, deleteButton), fields),
+		widget.NewSeparator(),
+	)
+}
+
+// toolSettings returns the per tool confirmation policies and a function saving them
+func toolSettings() (fyne.CanvasObject, func()) {
+	policies := map[string]*widget.Select{}
+	content := container.NewVBox(widget.NewLabel("Before a tool runs:"))
+	for _, name := range toolRegistry.Names() {
+		tool, _ := toolRegistry.Get(name)
+		policy := widget.NewSelect([]string{PolicyAllow, PolicyAsk, PolicyDeny}, nil)
+		policy.SetSelected(toolPolicy(tool))
+		policies[name] = policy
+
+		kind := "read only"
+		if !tool.ReadOnly() {
+			kind = "makes changes"
+		}
+		content.Add(container.NewBorder(nil, nil, nil, policy, widget.NewLabel(name+" ("+kind+")")))
+	}
+
+	return content, func() {
+		for name, policy := range policies {
+			tool, _ := toolRegistry.Get(name)
+			if policy.Selected == toolPolicy(tool) {
+				continue
+			}
+			if err := SaveToolPolicy(db, name, policy.Selected); err != nil {
+				log.Println("Error saving tool policy:", err)
+			}
+		}
+	}
+}
+
+// fileSettings returns the workspace folders the file tools may access and a function saving them
+func fileSettings(window fyne.Window) (fyne.CanvasObject, func()) {
+	roots := workspaceRoots()
+	changed := false
+
+	rootList := container.NewVBox()
+	var refresh func()
+	refresh = func() {
+		rootList.RemoveAll()
+		for i, root := range roots {
+			label := widget.NewLabel(root)
+			label.Truncation = fyne.TextTruncateEllipsis
+			remove := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+				roots = append(roots[:i:i], roots[i+1:]...)
+				changed = true
+				refresh()
+			})
+			rootList.Add(container.NewBorder(nil, nil, nil, remove, label))
+		}
+	}
+	refresh()
+
+	addButton := widget.NewButtonWithIcon("Add folder", theme.FolderNewIcon(), func() {
+		dialog.ShowFolderOpen(func(uri fyne.ListableURI, err error) {
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			if uri == nil || slices.Contains(roots, uri.Path()) {
+				return
+			}
+			roots = append(roots, uri.Path())
+			changed = true
+			refresh()
+		}, window)
+	})
+
+	extensions := GetSetting(db, "allowed_extensions", DefaultAllowedExtensions)
+	extensionsEntry := widget.NewEntry()
+	extensionsEntry.SetText(extensions)
+
+	content := container.NewVBox(
+		widget.NewLabel("Folders the assistant can access (new files go to the first one):"),
+		rootList,
+		addButton,
+		widget.NewLabel("File types the assistant can write (comma separated):"),
+		extensionsEntry,
+		widget.NewLabel("Recent file changes:"),
+		backupList(window),
+	)
+	return content, func() {
+		if extensionsEntry.Text != extensions {
+			if err := SaveSetting(db, "allowed_extensions", extensionsEntry.Text); err != nil {
+				log.Println("Error saving allowed extensions:", err)
+			}
+		}
+		if !changed {
+			return
+		}
+		if err := saveWorkspaceRoots(roots); err != nil {
+			log.Println("Error saving workspace roots:", err)
+		}
+	}
+}
+
+// backupList shows the recent backups of files changed by tools, each can be restored
+func backupList(window fyne.Window) fyne.CanvasObject {
+	list := container.NewVBox()
+	var refresh func()
+	refresh = func() {
+		list.RemoveAll()
+		backups, err := ListBackups(db, 0, 20)
+		if err != nil {
+			log.Println("Error listing backups:", err)
+		}
+		if len(backups) == 0 {
+			list.Add(widget.NewLabel("No changes yet"))
+		}
+		for _, backup := range backups {
+			action := "changed"
+			if backup.BackupPath == "" {
+				action = "created"
+			}
+			label := widget.NewLabel(fmt.Sprintf("%s %s %s", backup.CreatedAt.Format("Jan 2 15:04"), action, backup.Path))
+			label.Truncation = fyne.TextTruncateEllipsis
+			restore := widget.NewButtonWithIcon("", theme.ContentUndoIcon(), func() {
+				message := "Restore " + backup.Path + " to the state before this change?"
+				if backup.BackupPath == "" {
+					message = "Delete " + backup.Path + "? It did not exist before this change."
+				}
+				dialog.ShowConfirm("Undo file change", message, func(ok bool) {
+					if !ok {
+						return
+					}
+					if err := restoreBackup(backup); err != nil {
+						dialog.ShowError(err, window)
+						return
+					}
+					refresh()
+				}, window)
+			})
+			list.Add(container.NewBorder(nil, nil, nil, restore, label))
+		}
+	}
+	refresh()
+	return list
+}
+
+// screenSettings returns the screenshot settings and a function saving them
+func screenSettings(window fyne.Window) (fyne.CanvasObject, func()) {
+	mode, display := captureSettings()
+	modes := []string{CaptureDisplay, CaptureAll, CaptureWindow, CaptureRegion}
+	modeNames := []string{"One display", "All displays", "Active window", "Select a region"}
+
+	displays := displayNames()
+	if len(displays) == 0 {
+		displays = []string{"Display 1"}
+	}
+	displaySelect := widget.NewSelect(displays, nil)
+	displaySelect.SetSelectedIndex(min(display, len(displays)-1))
+
+	modeSelect := widget.NewSelect(modeNames, func(name string) {
+		if name == modeNames[0] {
+			displaySelect.Enable()
+		} else {
+			displaySelect.Disable()
+		}
+	})
+	modeSelect.SetSelectedIndex(max(slices.Index(modes, mode), 0))
+
+	opts := loadScreenshotOptions()
+	maxDimensionEntry := widget.NewEntry()
+	maxDimensionEntry.SetText(strconv.Itoa(opts.MaxDimension))
+	formatSelect := widget.NewSelect([]string{FormatPNG, FormatJPEG}, nil)
+	formatSelect.SetSelected(opts.Format)
+	qualitySlider := widget.NewSlider(10, 100)
+	qualitySlider.Step = 5
+	qualitySlider.SetValue(float64(opts.Quality))
+	qualityLabel := widget.NewLabel(fmt.Sprintf("JPEG quality: %d", opts.Quality))
+	qualitySlider.OnChanged = func(value float64) {
+		qualityLabel.SetText(fmt.Sprintf("JPEG quality: %d", int(value)))
+	}
+	grayscaleCheck := widget.NewCheck("Grayscale", nil)
+	grayscaleCheck.SetChecked(opts.Grayscale)
+
+	currentOptions := func() ScreenshotOptions {
+		maxDimension, err := strconv.Atoi(maxDimensionEntry.Text)
+		if err != nil || maxDimension < 0 {
+			maxDimension = opts.MaxDimension
+		}
+		return ScreenshotOptions{
+			MaxDimension: maxDimension,
+			Format:       formatSelect.Selected,
+			Quality:      int(qualitySlider.Value),
+			Grayscale:    grayscaleCheck.Checked,
+		}
+	}
+
+	// a test capture shows what the options cost before they are saved
+	sizeLabel := widget.NewLabel("")
+	testButton := widget.NewButton("Test capture", func() {
+		sizeLabel.SetText("Capturing...")
+		testMode := modes[modeSelect.SelectedIndex()]
+		testOptions := currentOptions()
+		go func() {
+			img, err := captureImage(testMode, displaySelect.SelectedIndex(), nil)
+			if err != nil {
+				sizeLabel.SetText(err.Error())
+				return
+			}
+			data, err := encodeScreenshot(img, testOptions)
+			if err != nil {
+				sizeLabel.SetText(err.Error())
+				return
+			}
+			sizeLabel.SetText(fmt.Sprintf("%dx%d captured, %s sent", img.Bounds().Dx(), img.Bounds().Dy(), formatSize(len(data))))
+		}()
+	})
+
+	content := container.NewVBox(
+		widget.NewLabel("Screenshots capture:"),
+		modeSelect,
+		widget.NewLabel("Display:"),
+		displaySelect,
+		widget.NewLabel("Max width/height in pixels (0 keeps the full resolution):"),
+		maxDimensionEntry,
+		widget.NewLabel("Format:"),
+		formatSelect,
+		qualityLabel,
+		qualitySlider,
+		grayscaleCheck,
+		container.NewBorder(nil, nil, testButton, nil, sizeLabel),
+	)
+	redaction, saveRedaction := redactionSettings(window)
+	content.Add(redaction)
+	return content, func() {
+		saveRedaction()
+		newMode := modes[modeSelect.SelectedIndex()]
+		newDisplay := displaySelect.SelectedIndex()
+		if newMode != mode || newDisplay != display {
+			if err := SaveSetting(db, "capture_mode", newMode); err != nil {
+				log.Println("Error saving capture mode:", err)
+			}
+			if err := SaveSetting(db, "capture_display", strconv.Itoa(newDisplay)); err != nil {
+				log.Println("Error saving capture display:", err)
+			}
+		}
+
+		newOptions := currentOptions()
+		if newOptions == opts {
+			return
+		}
+		settings := map[string]string{
+			"screenshot_max_dimension": strconv.Itoa(newOptions.MaxDimension),
+			"screenshot_format":        newOptions.Format,
+			"screenshot_quality":       strconv.Itoa(newOptions.Quality),
+			"screenshot_grayscale":     strconv.FormatBool(newOptions.Grayscale),
+		}
+		for key, value := range settings {
+			if err := SaveSetting(db, key, value); err != nil {
+				log.Println("Error saving screenshot settings:", err)
+			}
+		}
+	}
+}
+
+// redactionSettings returns what is hidden from screenshots and a function saving it
+func redactionSettings(window fyne.Window) (fyne.CanvasObject, func()) {
+	settings := loadRedactionSettings()
+	regions := slices.Clone(settings.Regions)
+	changed := false
+
+	regionList := container.NewVBox()
+	var refresh func()
+	refresh = func() {
+		regionList.RemoveAll()
+		for i, region := range regions {
+			label := widget.NewLabel(fmt.Sprintf("%dx%d at %d, %d", region.Dx(), region.Dy(), region.Min.X, region.Min.Y))
+			remove := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+				regions = append(regions[:i:i], regions[i+1:]...)
+				changed = true
+				refresh()
+			})
+			regionList.Add(container.NewBorder(nil, nil, nil, remove, label))
+		}
+	}
+	refresh()
+
+	// the region is drawn on a capture of all displays and stored in screen
+	// coordinates, so it stays put when the capture mode changes
+	selectRegion := regionSelector(fyne.CurrentApp(), "Drag over the area to hide from screenshots, Esc to cancel")
+	addButton := widget.NewButtonWithIcon("Add region", theme.ContentAddIcon(), func() {
+		go func() {
+			window.Hide()
+			defer window.Show()
+			n := screenshot.NumActiveDisplays()
+			if n <= 0 {
+				dialog.ShowError(fmt.Errorf("no active display found"), window)
+				return
+			}
+			img, screen, err := captureAllDisplays(n)
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			rect, ok := selectRegion(img)
+			if !ok {
+				return
+			}
+			scale := float64(screen.Dx()) / float64(img.Bounds().Dx())
+			toScreen := func(p image.Point) image.Point {
+				p = p.Sub(img.Bounds().Min)
+				return screen.Min.Add(image.Pt(int(float64(p.X)*scale), int(float64(p.Y)*scale)))
+			}
+			regions = append(regions, image.Rectangle{Min: toScreen(rect.Min), Max: toScreen(rect.Max)})
+			changed = true
+			refresh()
+		}()
+	})
+
+	windowsEntry := widget.NewMultiLineEntry()
+	windowsEntry.SetPlaceHolder("e.g. 1Password")
+	windowsEntry.SetText(strings.Join(settings.Windows, "\n"))
+	windowsEntry.SetMinRowsVisible(3)
+	reviewCheck := widget.NewCheck("Review and mask screenshots before they are sent", nil)
+	reviewCheck.SetChecked(settings.Review)
+
+	content := container.NewVBox(
+		widget.NewLabel("Hide these screen areas from screenshots:"),
+		regionList,
+		addButton,
+		widget.NewLabel("Hide windows of these apps or with these titles (one per line):"),
+		windowsEntry,
+		reviewCheck,
+	)
+	return content, func() {
+		var windows []string
+		for _, line := range strings.Split(windowsEntry.Text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				windows = append(windows, line)
+			}
+		}
+		if !changed && slices.Equal(windows, settings.Windows) && reviewCheck.Checked == settings.Review {
+			return
+		}
+		if err := saveRedactionSettings(RedactionSettings{Regions: regions, Windows: windows, Review: reviewCheck.Checked}); err != nil {
+			log.Println("Error saving redaction settings:", err)
+		}
+	}
+}
+
+// loadProviderConfig returns the provider selected in settings. The Gemini key
+// lives in the ApiKey table, everything else in settings.
+func loadProviderConfig(geminiKey string) ProviderConfig {
+	kind := GetSetting(db, "provider", ProviderGemini)
+	return ProviderConfig{
+		Kind:    kind,
+		APIKey:  providerAPIKey(kind, geminiKey),
+		BaseURL: GetSetting(db, "openai_base_url", ""),
+		Model:   GetSetting(db, kind+"_model", ""),
+	}
+}
+
+func providerAPIKey(kind string, geminiKey string) string {
+	if kind == ProviderGemini {
+		return geminiKey
+	}
+	return GetSetting(db, kind+"_api_key", "")
+}
+
+func saveProviderConfig(cfg ProviderConfig) error {
+	var err error
+	if cfg.Kind == ProviderGemini {
+		err = saveAPIKey(cfg.APIKey)
+	} else {
+		err = SaveSetting(db, cfg.Kind+"_api_key", cfg.APIKey)
+	}
+	if err != nil {
+		return err
+	}
+	if err := SaveSetting(db, "provider", cfg.Kind); err != nil {
+		return err
+	}
+	if err := SaveSetting(db, cfg.Kind+"_model", cfg.Model); err != nil {
+		return err
+	}
+	if cfg.Kind == ProviderOpenAI {
+		return SaveSetting(db, "openai_base_url", cfg.BaseURL)
+	}
+	return nil
+}
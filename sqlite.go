@@ -5,24 +5,104 @@ import (
 	"github.com/pkg/errors"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var db *gorm.DB
 
+// UserData is an item of the long-term memory, the title is unique. The JSON
+// form is used by memory_read and the memory export.
 type UserData struct {
-	ID          uint   `gorm:"primaryKey"`
-	Title       string `gorm:"not null"`
-	Description string `gorm:"not null"`
-	Value       string `gorm:"not null"`
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	Title          string    `gorm:"not null;uniqueIndex" json:"title"`
+	Description    string    `gorm:"not null" json:"description"`
+	Value          string    `gorm:"not null" json:"value"`
+	Pinned         bool      `gorm:"not null;default:false" json:"pinned"` // always given to the model
+	ConversationID *uint     `json:"conversation_id,omitempty"`            // the conversation it was last written in, nil if unknown
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
 }
 
+// MemoryEmbedding is the vector of a memory item computed by an embedding
+// model, see memoryVectors
+type MemoryEmbedding struct {
+	DataID   uint   `gorm:"primaryKey"`
+	Model    string `gorm:"primaryKey"`
+	TextHash string `gorm:"not null"` // of the item text the vector was computed from
+	Vector   []byte `gorm:"not null"` // little endian float32s
+}
+
+// ErrTitleTaken is returned when a memory item is renamed to a title in use
+var ErrTitleTaken = errors.New("a memory item with this title already exists")
+
+// memoryVersion counts the changes of the memory, caches of it compare the
+// version they were loaded at
+var memoryVersion atomic.Uint64
+
 type ApiKey struct {
 	ID     uint   `gorm:"primaryKey"`
 	ApiKey string `gorm:"not null"`
 }
 
+// Conversation is a chat saved to the database, see recordingChat
+type Conversation struct {
+	ID        uint   `gorm:"primaryKey"`
+	Title     string `gorm:"not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Message is a single turn of a conversation
+type Message struct {
+	ID             uint   `gorm:"primaryKey"`
+	ConversationID uint   `gorm:"index;not null"`
+	Role           string `gorm:"not null"`
+	Parts          string `gorm:"not null"` // JSON, see encodeParts
+	Attachments    string // JSON list of Attachment, file contents are not stored
+	PromptTokens   int32
+	OutputTokens   int32
+	CreatedAt      time.Time
+}
+
+// ToolPolicy stores whether a tool may run without asking, see toolPolicy
+type ToolPolicy struct {
+	ToolName string `gorm:"primaryKey"`
+	Policy   string `gorm:"not null"`
+}
+
+// FileBackup is a snapshot of a file taken before a tool changed it, see backupFile
+type FileBackup struct {
+	ID         uint   `gorm:"primaryKey"`
+	Path       string `gorm:"not null"`
+	BackupPath string // empty if the file did not exist before
+	CreatedAt  time.Time
+}
+
+// UploadedFile is an attachment stored with the Gemini File API. It is reused
+// when the same content is attached again with the same API key.
+type UploadedFile struct {
+	Hash      string `gorm:"primaryKey"` // sha256 of the content
+	Account   string `gorm:"primaryKey"` // short hash of the API key
+	Name      string // name on the server, files/...
+	URI       string `gorm:"index"`
+	MIMEType  string
+	Size      int64
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// Setting is a simple key/value pair for user preferences
+type Setting struct {
+	Key   string `gorm:"primaryKey"`
+	Value string `gorm:"not null"`
+}
+
 func InitDB() (*gorm.DB, error) {
 	supportDir, err := getAppSupportDir()
 	if err != nil {
@@ -44,18 +124,298 @@ func InitDB() (*gorm.DB, error) {
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&UserData{}, &ApiKey{})
+	// the triggers stop memory writes if this build has no FTS5, they are
+	// created again by initMemorySearch if it has
+	for name := range memorySearchTriggers {
+		if err := db.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := migrateUserData(db); err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&UserData{}, &ApiKey{}, &Setting{}, &Conversation{}, &Message{}, &ToolPolicy{}, &FileBackup{}, &UploadedFile{}, &MemoryEmbedding{})
+	if err != nil {
+		return nil, err
+	}
+	// memory written before timestamps were kept
+	err = db.Exec("UPDATE user_data SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE created_at IS NULL").Error
 	if err != nil {
 		return nil, err
 	}
+	memoryVersion.Add(1)
+	memoryFTS = initMemorySearch(db)
+	if memoryFTS {
+		log.Println("Memory search: SQLite FTS5")
+	} else {
+		log.Println("Memory search: LIKE, build with -tags sqlite_fts5 (see the Makefile) for full text search")
+	}
+	// vectors of deleted memory items
+	if err := db.Exec("DELETE FROM memory_embeddings WHERE data_id NOT IN (SELECT id FROM user_data)").Error; err != nil {
+		return nil, err
+	}
 
 	return db, nil
 }
 
-func InsertData(db *gorm.DB, title string, desc string, value string) error {
-	log.Println("Inserting data into db: ", title)
-	message := UserData{Title: title, Description: desc, Value: value}
-	return db.Create(&message).Error
+// migrateUserData prepares the memory of older versions for the unique
+// title, of items with the same title only the newest is kept
+func migrateUserData(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&UserData{}) || db.Migrator().HasIndex(&UserData{}, "Title") {
+		return nil
+	}
+	result := db.Exec("DELETE FROM user_data WHERE id NOT IN (SELECT MAX(id) FROM user_data GROUP BY title)")
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "failed to remove duplicate memory items")
+	}
+	if result.RowsAffected > 0 {
+		log.Println("Removed", result.RowsAffected, "outdated memory items")
+	}
+	return nil
+}
+
+// memoryFTS is true if memory is searched with SQLite FTS5. The driver only
+// has FTS5 when built with -tags sqlite_fts5, which the Makefile does,
+// otherwise SearchData falls back to LIKE.
+var memoryFTS bool
+
+// memorySearchTriggers keep the FTS5 index in sync with user_data
+var memorySearchTriggers = map[string]string{
+	"user_data_fts_insert": "AFTER INSERT ON user_data BEGIN " +
+		"INSERT INTO user_data_fts(rowid, title, description, value) VALUES (new.id, new.title, new.description, new.value); END",
+	"user_data_fts_delete": "AFTER DELETE ON user_data BEGIN " +
+		"INSERT INTO user_data_fts(user_data_fts, rowid, title, description, value) VALUES ('delete', old.id, old.title, old.description, old.value); END",
+	"user_data_fts_update": "AFTER UPDATE ON user_data BEGIN " +
+		"INSERT INTO user_data_fts(user_data_fts, rowid, title, description, value) VALUES ('delete', old.id, old.title, old.description, old.value); " +
+		"INSERT INTO user_data_fts(rowid, title, description, value) VALUES (new.id, new.title, new.description, new.value); END",
+}
+
+// initMemorySearch sets up the FTS5 index of the memory and reports whether
+// it is available
+func initMemorySearch(db *gorm.DB) bool {
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS user_data_fts USING fts5(title, description, value, content='user_data', content_rowid='id')").Error
+	if err == nil {
+		// memory may have changed without the triggers. This also fails
+		// without FTS5 if an earlier build created the table.
+		err = db.Exec("INSERT INTO user_data_fts(user_data_fts) VALUES ('rebuild')").Error
+	}
+	if err != nil {
+		log.Println("Full text search is not available:", err)
+		return false
+	}
+	for name, trigger := range memorySearchTriggers {
+		if err := db.Exec("CREATE TRIGGER " + name + " " + trigger).Error; err != nil {
+			log.Println("Error creating memory search trigger:", err)
+			return false
+		}
+	}
+	return true
+}
+
+// SearchData returns up to limit memory items matching any of the keywords,
+// the best matches first. Matches in the title count more.
+func SearchData(db *gorm.DB, keywords []string, limit int) ([]UserData, error) {
+	if len(keywords) == 0 {
+		return nil, nil
+	}
+	if memoryFTS {
+		quoted := make([]string, len(keywords))
+		for i, keyword := range keywords {
+			quoted[i] = `"` + strings.ReplaceAll(keyword, `"`, `""`) + `"*`
+		}
+		var items []UserData
+		err := db.Raw("SELECT user_data.* FROM user_data_fts JOIN user_data ON user_data.id = user_data_fts.rowid "+
+			"WHERE user_data_fts MATCH ? ORDER BY bm25(user_data_fts, 3.0, 1.0, 1.0) LIMIT ?", strings.Join(quoted, " OR "), limit).
+			Scan(&items).Error
+		return items, err
+	}
+
+	tx := db.Model(&UserData{}).Order("updated_at DESC")
+	for _, keyword := range keywords {
+		like := "%" + keyword + "%"
+		tx = tx.Or("title LIKE ? OR description LIKE ? OR value LIKE ?", like, like, like)
+	}
+	var candidates []UserData
+	if err := tx.Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	scores := map[uint]int{}
+	for _, item := range candidates {
+		title := strings.ToLower(item.Title)
+		text := strings.ToLower(item.Description + " " + item.Value)
+		for _, keyword := range keywords {
+			if strings.Contains(title, keyword) {
+				scores[item.ID] += 3
+			}
+			if strings.Contains(text, keyword) {
+				scores[item.ID]++
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].ID] > scores[candidates[j].ID]
+	})
+	return candidates[:min(limit, len(candidates))], nil
+}
+
+// PinnedData returns the pinned memory items
+func PinnedData(db *gorm.DB) ([]UserData, error) {
+	var items []UserData
+	err := db.Where("pinned = ?", true).Order("title").Find(&items).Error
+	return items, err
+}
+
+// UpsertData saves a memory item under its title, replacing the item with
+// that title if there is one. previous is the replaced item, nil if the
+// title is new. The pin and the conversation of the replaced item are kept
+// unless item sets them.
+func UpsertData(db *gorm.DB, item UserData) (previous *UserData, err error) {
+	defer memoryVersion.Add(1)
+	log.Println("Saving data to db: ", item.Title)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var existing UserData
+		err := tx.Where("title = ?", item.Title).First(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(&item).Error
+		}
+		if err != nil {
+			return err
+		}
+		previous = &existing
+		item.ID = existing.ID
+		item.CreatedAt = existing.CreatedAt
+		item.Pinned = item.Pinned || existing.Pinned
+		if item.ConversationID == nil {
+			item.ConversationID = existing.ConversationID
+		}
+		return tx.Save(&item).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// GetData returns the memory item with the title, gorm.ErrRecordNotFound if there is none
+func GetData(db *gorm.DB, title string) (*UserData, error) {
+	var item UserData
+	if err := db.Where("title = ?", title).First(&item).Error; err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// UpdateData changes the columns in updates of the memory item with the
+// title and returns the item as it was before. Renaming it to a title in
+// use fails with ErrTitleTaken.
+func UpdateData(db *gorm.DB, title string, updates map[string]any) (*UserData, error) {
+	defer memoryVersion.Add(1)
+	log.Println("Updating data in db: ", title)
+	var previous UserData
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("title = ?", title).First(&previous).Error; err != nil {
+			return err
+		}
+		if newTitle, ok := updates["title"]; ok && newTitle != title {
+			var count int64
+			if err := tx.Model(&UserData{}).Where("title = ?", newTitle).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrTitleTaken
+			}
+		}
+		return tx.Model(&UserData{}).Where("id = ?", previous.ID).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &previous, nil
+}
+
+// ListData returns the memory items containing query in their title,
+// description or value, pinned items first and then the most recent.
+// A limit of -1 returns all of them.
+func ListData(db *gorm.DB, query string, limit int) ([]UserData, error) {
+	var items []UserData
+	tx := db.Order("pinned DESC, updated_at DESC").Limit(limit)
+	if query != "" {
+		like := "%" + query + "%"
+		tx = tx.Where("title LIKE ? OR description LIKE ? OR value LIKE ?", like, like, like)
+	}
+	err := tx.Find(&items).Error
+	return items, err
+}
+
+func SetDataPinned(db *gorm.DB, id uint, pinned bool) error {
+	defer memoryVersion.Add(1)
+	return db.Model(&UserData{}).Where("id = ?", id).Update("pinned", pinned).Error
+}
+
+// ImportData saves memory items under their titles like UpsertData and
+// returns how many replaced an existing item. Nothing is saved if one fails.
+func ImportData(db *gorm.DB, items []UserData) (replaced int, err error) {
+	defer memoryVersion.Add(1)
+	log.Println("Importing", len(items), "memory items")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		replaced = 0
+		for _, item := range items {
+			// IDs and conversations of another database mean nothing here
+			item.ID = 0
+			item.ConversationID = nil
+			previous, err := UpsertData(tx, item)
+			if err != nil {
+				return errors.Wrapf(err, "failed to import %q", item.Title)
+			}
+			if previous != nil {
+				replaced++
+			}
+		}
+		return nil
+	})
+	return replaced, err
+}
+
+// ChangeMemory runs fn in a transaction, for changes of several memory items
+// which are saved together or not at all
+func ChangeMemory(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	defer memoryVersion.Add(1)
+	return db.Transaction(fn)
+}
+
+// ListEmbeddings returns the vectors computed by an embedding model
+func ListEmbeddings(db *gorm.DB, model string) ([]MemoryEmbedding, error) {
+	var embeddings []MemoryEmbedding
+	err := db.Where("model = ?", model).Find(&embeddings).Error
+	return embeddings, err
+}
+
+// SaveEmbeddings stores vectors, replacing those of the same item and model
+func SaveEmbeddings(db *gorm.DB, embeddings []MemoryEmbedding) error {
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&embeddings).Error
+}
+
+// DeleteDataByTitle deletes the memory item with the title and its vectors,
+// ok is false if there is none
+func DeleteDataByTitle(db *gorm.DB, title string) (ok bool, err error) {
+	defer memoryVersion.Add(1)
+	log.Println("Deleting data from db: ", title)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var item UserData
+		err := tx.Where("title = ?", title).First(&item).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("data_id = ?", item.ID).Delete(&MemoryEmbedding{}).Error; err != nil {
+			return err
+		}
+		ok = true
+		return tx.Delete(&item).Error
+	})
+	return ok, err
 }
 
 func ReadDataAsJSON(db *gorm.DB) (string, error) {
@@ -97,21 +457,141 @@ func GetApiKey(db *gorm.DB) (string, error) {
 	return apiKey.ApiKey, nil
 }
 
-func DumpRows(db *gorm.DB) (string, error) {
-	var data []UserData
-	err := db.Find(&data).Error
+// GetSetting returns the stored value for key or def if it is not set
+func GetSetting(db *gorm.DB, key string, def string) string {
+	var setting Setting
+	err := db.Where(&Setting{Key: key}).First(&setting).Error
 	if err != nil {
-		return "", err
+		return def
+	}
+	return setting.Value
+}
+
+func SaveSetting(db *gorm.DB, key string, value string) error {
+	log.Println("Saving setting to db:", key)
+	return db.Save(&Setting{Key: key, Value: value}).Error
+}
+
+func CreateConversation(db *gorm.DB, title string) (*Conversation, error) {
+	log.Println("Creating conversation:", title)
+	conversation := Conversation{Title: title}
+	err := db.Create(&conversation).Error
+	if err != nil {
+		return nil, err
 	}
+	return &conversation, nil
+}
 
-	var output string
-	for _, row := range data {
-		output += row.Title + " - " + row.Description + " - " + row.Value + "\n"
+// InsertMessages saves messages and bumps the conversation's UpdatedAt
+func InsertMessages(db *gorm.DB, conversationID uint, messages []Message) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for i := range messages {
+			messages[i].ConversationID = conversationID
+			if err := tx.Create(&messages[i]).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&Conversation{ID: conversationID}).Update("updated_at", time.Now()).Error
+	})
+}
+
+// ListConversations returns all conversations, most recently updated first
+func ListConversations(db *gorm.DB) ([]Conversation, error) {
+	var conversations []Conversation
+	err := db.Order("updated_at desc").Find(&conversations).Error
+	if err != nil {
+		return nil, err
 	}
-	return output, nil
+	return conversations, nil
+}
+
+func GetMessages(db *gorm.DB, conversationID uint) ([]Message, error) {
+	var messages []Message
+	err := db.Where("conversation_id = ?", conversationID).Order("id").Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func DeleteConversation(db *gorm.DB, conversationID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("conversation_id = ?", conversationID).Delete(&Message{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Conversation{}, conversationID).Error
+	})
+}
+
+// GetToolPolicy returns the stored policy of a tool or def if it is not set
+func GetToolPolicy(db *gorm.DB, toolName string, def string) string {
+	var policy ToolPolicy
+	err := db.Where(&ToolPolicy{ToolName: toolName}).First(&policy).Error
+	if err != nil {
+		return def
+	}
+	return policy.Policy
+}
+
+func SaveToolPolicy(db *gorm.DB, toolName string, policy string) error {
+	log.Println("Saving tool policy:", toolName, policy)
+	return db.Save(&ToolPolicy{ToolName: toolName, Policy: policy}).Error
+}
+
+func InsertBackup(db *gorm.DB, backup *FileBackup) error {
+	log.Println("Backing up file:", backup.Path)
+	return db.Create(backup).Error
+}
+
+// ListBackups returns the newest backups first, offset skips the newest ones
+func ListBackups(db *gorm.DB, offset int, limit int) ([]FileBackup, error) {
+	var backups []FileBackup
+	err := db.Order("id desc").Offset(offset).Limit(limit).Find(&backups).Error
+	if err != nil {
+		return nil, err
+	}
+	return backups, nil
+}
+
+func DeleteBackup(db *gorm.DB, id uint) error {
+	return db.Delete(&FileBackup{}, id).Error
+}
+
+// FindUploadedFile returns the upload of a content hash which is still valid
+// at validUntil, or nil if there is none
+func FindUploadedFile(db *gorm.DB, hash string, account string, validUntil time.Time) (*UploadedFile, error) {
+	var files []UploadedFile
+	err := db.Where("hash = ? AND account = ? AND expires_at > ?", hash, account, validUntil).Limit(1).Find(&files).Error
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return &files[0], nil
+}
+
+// GetUploadedFileByURI returns the upload with the given URI, or nil if it is unknown
+func GetUploadedFileByURI(db *gorm.DB, uri string) (*UploadedFile, error) {
+	var files []UploadedFile
+	err := db.Where("uri = ?", uri).Limit(1).Find(&files).Error
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return &files[0], nil
+}
+
+func SaveUploadedFile(db *gorm.DB, file *UploadedFile) error {
+	return db.Save(file).Error
+}
+
+// DeleteExpiredUploads forgets uploads the server has already deleted
+func DeleteExpiredUploads(db *gorm.DB) error {
+	return db.Where("expires_at <= ?", time.Now()).Delete(&UploadedFile{}).Error
 }
 
 func DeleteData(db *gorm.DB) error {
+	defer memoryVersion.Add(1)
+	if err := db.Exec("DELETE FROM memory_embeddings").Error; err != nil {
+		return err
+	}
 	return db.Exec("DELETE FROM user_data").Error
 }
 
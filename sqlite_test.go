@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// useTestDB points db at a new database in a temporary home directory for
+// the duration of the test
+func useTestDB(t *testing.T) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	testDB, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		if sqlDB, err := testDB.DB(); err == nil {
+			sqlDB.Close()
+		}
+		db = previous
+	})
+}
+
+func TestUpsertDataKeepsConversation(t *testing.T) {
+	useTestDB(t)
+	conversation := uint(7)
+	if _, err := UpsertData(db, UserData{Title: "pet", Value: "cat", ConversationID: &conversation}); err != nil {
+		t.Fatal(err)
+	}
+	// an import or an edit in settings doesn't come from a conversation
+	previous, err := UpsertData(db, UserData{Title: "pet", Value: "dog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous == nil || previous.Value != "cat" {
+		t.Fatalf("previous = %+v", previous)
+	}
+	item, err := GetData(db, "pet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Value != "dog" || item.ConversationID == nil || *item.ConversationID != conversation {
+		t.Errorf("item = %+v, want the value replaced and conversation %d kept", item, conversation)
+	}
+
+	other := uint(9)
+	if _, err := UpsertData(db, UserData{Title: "pet", Value: "fish", ConversationID: &other}); err != nil {
+		t.Fatal(err)
+	}
+	if item, _ := GetData(db, "pet"); item.ConversationID == nil || *item.ConversationID != other {
+		t.Errorf("conversation = %v, want %d", item.ConversationID, other)
+	}
+}
+
+func TestDeleteDataByTitleDropsVectors(t *testing.T) {
+	useTestDB(t)
+	for _, title := range []string{"keep", "drop"} {
+		if _, err := UpsertData(db, UserData{Title: title, Value: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := ListData(db, "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memoryVectors(context.Background(), localEmbedder{}, items); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := DeleteDataByTitle(db, "drop")
+	if err != nil || !ok {
+		t.Fatalf("DeleteDataByTitle = %v, %v", ok, err)
+	}
+	embeddings, err := ListEmbeddings(db, localEmbedder{}.EmbeddingModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep, _ := GetData(db, "keep")
+	if len(embeddings) != 1 || embeddings[0].DataID != keep.ID {
+		t.Errorf("embeddings left = %+v, want only the one of keep", embeddings)
+	}
+
+	if ok, err := DeleteDataByTitle(db, "drop"); ok || err != nil {
+		t.Errorf("deleting again = %v, %v, want false, nil", ok, err)
+	}
+}
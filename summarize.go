@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"strings"
+	"time"
+)
+
+const (
+	maxTranscriptChars = 100000 // of a conversation given to the model for summarizing, the start is cut
+	maxSummaryMemory   = 200    // memory items the model sees to avoid duplicates
+	summaryTimeout     = 2 * time.Minute
+)
+
+const summaryPrompt = `You extract facts worth remembering long-term from a conversation between a user and an assistant.
+Only extract durable facts about the user and their preferences, people, projects, plans and standing instructions, which will still matter in later conversations.
+Leave out small talk, the questions themselves, one-off tasks and anything the assistant said that the user did not confirm.
+Reuse the title of an existing memory item if a fact updates it. Leave out facts the memory already holds.
+Answer with a JSON array only, without any other text, like [{"title": "username", "description": "Name of the user", "value": "Thomas"}]. Answer [] if there is nothing worth remembering.`
+
+// memoryCandidate is a fact proposed for memory at the end of a conversation
+type memoryCandidate struct {
+	Item     UserData
+	Previous *UserData // the item it replaces, nil if the title is new
+}
+
+// summaryEnabled reports whether the user is offered facts to remember when
+// a conversation ends
+func summaryEnabled() bool {
+	return GetSetting(db, "memory_summarize", "false") == "true"
+}
+
+// worthSummarizing reports whether history has a user message and an answer
+func worthSummarizing(history []*genai.Content) bool {
+	user, model := false, false
+	for _, content := range history {
+		if messageText(content) == "" {
+			continue
+		}
+		user = user || content.Role == "user"
+		model = model || content.Role == "model"
+	}
+	return user && model
+}
+
+// summarizeConversation asks the model for the durable facts of a
+// conversation and returns those memory does not hold yet
+func summarizeConversation(ctx context.Context, provider Provider, history []*genai.Content) ([]memoryCandidate, error) {
+	existing, err := ListData(db, "", maxSummaryMemory)
+	if err != nil {
+		return nil, err
+	}
+	var memory strings.Builder
+	for _, item := range existing {
+		fmt.Fprintf(&memory, "%s: %s - %s\n", item.Title, item.Description, item.Value)
+	}
+	if memory.Len() == 0 {
+		memory.WriteString("(empty)\n")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, summaryTimeout)
+	defer cancel()
+	session := provider.StartChat(ChatConfig{SystemPrompt: summaryPrompt, MaxOutputTokens: 2000, Temperature: 0.2})
+	message := "Memory items (Title: Description - Value):\n" + memory.String() + "\nConversation:\n" + conversationTranscript(history)
+	res, err := session.SendMessage(ctx, genai.Text(message))
+	if err != nil {
+		return nil, err
+	}
+	facts, err := parseMemoryFacts(res.Text())
+	if err != nil {
+		return nil, err
+	}
+
+	// the model only saw part of a large memory
+	all, err := ListData(db, "", -1)
+	if err != nil {
+		return nil, err
+	}
+	return dedupeMemoryFacts(facts, all), nil
+}
+
+// conversationTranscript returns the messages of history as text, without
+// attached files and tool calls
+func conversationTranscript(history []*genai.Content) string {
+	var transcript strings.Builder
+	for _, content := range history {
+		var texts []string
+		for _, part := range content.Parts {
+			if text, ok := part.(genai.Text); ok && text != "" && !strings.HasPrefix(string(text), "--- file: ") {
+				texts = append(texts, string(text))
+			}
+		}
+		if len(texts) == 0 {
+			continue
+		}
+		speaker := "User"
+		if content.Role == "model" {
+			speaker = "Assistant"
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", speaker, strings.Join(texts, "\n"))
+	}
+	text := transcript.String()
+	if len(text) > maxTranscriptChars {
+		text = "...\n" + strings.ToValidUTF8(text[len(text)-maxTranscriptChars:], "")
+	}
+	return text
+}
+
+// parseMemoryFacts reads the JSON array answered by the model, which may be
+// wrapped in a code block or text
+func parseMemoryFacts(answer string) ([]UserData, error) {
+	start := strings.Index(answer, "[")
+	end := strings.LastIndex(answer, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("the model did not answer with a list of facts: %q", previewText(answer))
+	}
+	var facts []UserData
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &facts); err != nil {
+		return nil, fmt.Errorf("the model answered with invalid facts: %v", err)
+	}
+	return facts, nil
+}
+
+// dedupeMemoryFacts drops facts without title or value, repeated titles and
+// facts memory holds already, under their title or another one. A fact with
+// the title of an item but another value replaces it.
+func dedupeMemoryFacts(facts []UserData, existing []UserData) []memoryCandidate {
+	normal := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(s), " "))
+	}
+	byTitle := map[string]UserData{}
+	known := map[string]bool{} // description and value of every item
+	for _, item := range existing {
+		byTitle[normal(item.Title)] = item
+		known[normal(item.Description)+"\x00"+normal(item.Value)] = true
+	}
+
+	var candidates []memoryCandidate
+	seen := map[string]bool{}
+	for _, fact := range facts {
+		fact = UserData{Title: strings.TrimSpace(fact.Title), Description: strings.TrimSpace(fact.Description), Value: strings.TrimSpace(fact.Value)}
+		title := normal(fact.Title)
+		if title == "" || fact.Value == "" || seen[title] {
+			continue
+		}
+		seen[title] = true
+		if known[normal(fact.Description)+"\x00"+normal(fact.Value)] {
+			continue
+		}
+		candidate := memoryCandidate{Item: fact}
+		if previous, ok := byTitle[title]; ok {
+			if normal(previous.Value) == normal(fact.Value) {
+				continue
+			}
+			candidate.Item.Title = previous.Title
+			candidate.Previous = &previous
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
@@ -1,139 +1,607 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/google/generative-ai-go/genai"
 	"github.com/pkg/errors"
-	"gorm.io/gorm"
+	"io/fs"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 )
 
-var fileWriteSchema = &genai.Schema{
+var fileReadSchema = &genai.Schema{
 	Type: genai.TypeObject,
 	Properties: map[string]*genai.Schema{
 		"fileName": {
 			Type:        genai.TypeString,
-			Description: "The name of the file to write to. Do not include extension, it will be automatically added (.txt)",
+			Description: "The name of the file to read (including extension), relative to the workspace folder or an absolute path inside an allowed folder",
 		},
-		"content": {
-			Type:        genai.TypeString,
-			Description: "The text content to write to the file",
+		"offset": {
+			Type:        genai.TypeInteger,
+			Description: "The number of lines to skip, to continue reading a long file",
 		},
-	},
-	Required: []string{"fileName", "content"},
-}
-
-var fileReadSchema = &genai.Schema{
-	Type: genai.TypeObject,
-	Properties: map[string]*genai.Schema{
-		"fileName": {
-			Type:        genai.TypeString,
-			Description: "The name of the file to read (including extension)",
+		"limit": {
+			Type:        genai.TypeInteger,
+			Description: "The maximum number of lines to return, default 2000",
 		},
 	},
 	Required: []string{"fileName"},
 }
 
-var memoryWriteSchema = &genai.Schema{
+var fileListSchema = &genai.Schema{
 	Type: genai.TypeObject,
 	Properties: map[string]*genai.Schema{
-		"title": {
+		"dir": {
 			Type:        genai.TypeString,
-			Description: "The title of the memory value, for example username.",
+			Description: "The folder to list, all workspace folders if empty",
 		},
-		"description": {
-			Type:        genai.TypeString,
-			Description: "The description of the memory value, for example Name of the User.",
+		"depth": {
+			Type:        genai.TypeInteger,
+			Description: "How many folder levels to list, 1 (default) lists only the folder itself",
 		},
-		"value": {
+		"glob": {
 			Type:        genai.TypeString,
-			Description: "The value of the memory value, for example Thomas.",
+			Description: "Only list files whose name matches this glob, e.g. *.csv",
 		},
 	},
-	Required: []string{"title", "description", "value"},
 }
 
-var FileTool = &genai.Tool{
-	FunctionDeclarations: []*genai.FunctionDeclaration{
-		{
-			Name:        "file_write", //TODO add modes, write, append
-			Description: "write a text file to user local file system with specified name and content.",
-			Parameters:  fileWriteSchema,
-		},
-		{
-			Name:        "file_read",
-			Description: "read a file from user local file system with specified name.",
-			Parameters:  fileReadSchema,
-		},
-		{
-			Name:        "file_list",
-			Description: "get list of user file names, separated by comma",
-		},
-		{
-			Name:        "memory_read",
-			Description: "returns the long term memory database with all values",
-		},
-		{
-			Name:        "memory_write",
-			Description: "write a value to the long term memory database to remember it forever",
-			Parameters:  memoryWriteSchema,
-		},
-	},
+// Tool is a function the model can call. To add a tool implement this
+// interface and add it to toolRegistry, arguments are validated against
+// Schema before Invoke is called.
+type Tool interface {
+	Name() string
+	Description() string
+	Schema() *genai.Schema // nil if the tool takes no arguments
+	ReadOnly() bool        // false if the tool changes files, memory...
+	Invoke(ctx context.Context, args map[string]any) (map[string]any, error)
 }
 
-func WriteDesktop(fileName string, content string) error {
-	// TODO if the file is txt, convert markdown to txt
-	fileName = fileName + ".txt"
-	home, _ := os.UserHomeDir()
-	fullPath := filepath.Join(home, "Desktop", fileName)
+// ToolError is an error the model can act on, it is sent back with its code
+type ToolError struct {
+	Code    string
+	Message string
+}
 
-	formattedContent := strings.ReplaceAll(content, "\\n", "\n")
+func (e *ToolError) Error() string {
+	return e.Message
+}
 
-	err := os.WriteFile(fullPath, []byte(formattedContent), 0644)
+// ToolPreviewer is implemented by tools which can describe what a call will
+// do, the description is shown when the user is asked to confirm it
+type ToolPreviewer interface {
+	Preview(args map[string]any) string
+}
+
+// Tool policies, stored per tool in the database
+const (
+	PolicyAllow = "allow" // run without asking
+	PolicyAsk   = "ask"   // ask the user before every call
+	PolicyDeny  = "deny"  // never run
+)
+
+// ConfirmFunc asks the user whether a tool call may run
+type ConfirmFunc func(ctx context.Context, tool Tool, args map[string]any, preview string) (bool, error)
+
+// toolPolicy returns the stored policy of a tool. Read only tools are allowed
+// by default, the user is asked before anything else runs.
+func toolPolicy(tool Tool) string {
+	def := PolicyAsk
+	if tool.ReadOnly() {
+		def = PolicyAllow
+	}
+	if db == nil {
+		return def
+	}
+	return GetToolPolicy(db, tool.Name(), def)
+}
+
+// toolRegistry holds the tools offered to the model
+var toolRegistry = NewToolRegistry(
+	fileWriteTool{},
+	fileEditTool{},
+	fileReadTool{},
+	fileListTool{},
+	fileSearchTool{},
+	fileGrepTool{},
+	memoryReadTool{},
+	memorySearchTool{},
+	memoryWriteTool{},
+	memoryUpdateTool{},
+	memoryDeleteTool{},
+)
+
+// ToolRegistry generates the function declarations of its tools and dispatches calls to them
+type ToolRegistry struct {
+	tools map[string]Tool
+	names []string // registration order, keeps declarations stable
+
+	// Confirm is set by the front end, calls needing confirmation are refused without it
+	Confirm ConfirmFunc
+}
+
+func NewToolRegistry(tools ...Tool) *ToolRegistry {
+	r := &ToolRegistry{tools: map[string]Tool{}}
+	for _, tool := range tools {
+		if err := r.Register(tool); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+func (r *ToolRegistry) Register(tool Tool) error {
+	if _, ok := r.tools[tool.Name()]; ok {
+		return fmt.Errorf("tool %s is already registered", tool.Name())
+	}
+	r.tools[tool.Name()] = tool
+	r.names = append(r.names, tool.Name())
+	return nil
+}
+
+func (r *ToolRegistry) Get(name string) (Tool, bool) {
+	tool, ok := r.tools[name]
+	return tool, ok
+}
+
+// Names returns the names of the registered tools in registration order
+func (r *ToolRegistry) Names() []string {
+	return r.names
+}
+
+// Declarations returns the genai tool declaring all registered tools
+func (r *ToolRegistry) Declarations() *genai.Tool {
+	declarations := &genai.Tool{}
+	for _, name := range r.names {
+		tool := r.tools[name]
+		declarations.FunctionDeclarations = append(declarations.FunctionDeclarations, &genai.FunctionDeclaration{
+			Name:        tool.Name(),
+			Description: tool.Description(),
+			Parameters:  tool.Schema(),
+		})
+	}
+	return declarations
+}
+
+// Call validates the arguments of a function call and invokes the tool, it is a ToolHandler
+func (r *ToolRegistry) Call(ctx context.Context, call genai.FunctionCall) (map[string]any, error) {
+	log.Println("Function call:", call.Name)
+	tool, ok := r.tools[call.Name]
+	if !ok {
+		return nil, errors.New("unknown function call")
+	}
+	args := call.Args
+	if args == nil {
+		args = map[string]any{}
+	}
+	if err := validateArgs(tool.Schema(), args); err != nil {
+		return nil, err
+	}
+
+	switch toolPolicy(tool) {
+	case PolicyDeny:
+		return nil, fmt.Errorf("the user does not allow the %s tool", call.Name)
+	case PolicyAsk:
+		if r.Confirm == nil {
+			return nil, fmt.Errorf("the %s tool needs confirmation from the user, which is not available", call.Name)
+		}
+		preview := toolCallJSON(args)
+		if previewer, ok := tool.(ToolPreviewer); ok {
+			preview = previewer.Preview(args)
+		}
+		ok, err := r.Confirm(ctx, tool, args, preview)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("the user declined the %s call", call.Name)
+		}
+	}
+
+	return tool.Invoke(ctx, args)
+}
+
+// toolCallJSON formats tool arguments and results for the user
+func toolCallJSON(value map[string]any) string {
+	data, err := json.MarshalIndent(value, "", "  ")
 	if err != nil {
-		return err
+		return fmt.Sprint(value)
+	}
+	text := string(data)
+	if len(text) > 1000 {
+		text = strings.ToValidUTF8(text[:1000], "") + "..."
+	}
+	return text
+}
+
+// validateArgs checks args against an object schema: required keys must be
+// present (strings non-empty) and every known key must have the right type
+func validateArgs(schema *genai.Schema, args map[string]any) error {
+	if schema == nil {
+		return nil
+	}
+	for _, key := range schema.Required {
+		value, ok := args[key]
+		if !ok || value == nil {
+			return fmt.Errorf("missing required argument '%s'", key)
+		}
+		if str, ok := value.(string); ok && str == "" && schema.Properties[key].Type == genai.TypeString {
+			return fmt.Errorf("expected non-empty string at key '%s'", key)
+		}
+	}
+	for key, value := range args {
+		prop, ok := schema.Properties[key]
+		if !ok || value == nil {
+			continue
+		}
+		if err := validateValue(prop, value); err != nil {
+			return fmt.Errorf("invalid argument '%s': %v", key, err)
+		}
+	}
+	return nil
+}
+
+func validateValue(schema *genai.Schema, value any) error {
+	switch schema.Type {
+	case genai.TypeString:
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected string, got %T", value)
+		}
+		if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, str) {
+			return fmt.Errorf("expected one of %s", strings.Join(schema.Enum, ", "))
+		}
+	case genai.TypeNumber:
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("expected number, got %T", value)
+		}
+	case genai.TypeInteger:
+		num, ok := value.(float64)
+		if !ok || num != math.Trunc(num) {
+			return fmt.Errorf("expected integer, got %v", value)
+		}
+	case genai.TypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("expected boolean, got %T", value)
+		}
+	case genai.TypeArray:
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("expected array, got %T", value)
+		}
+		if schema.Items != nil {
+			for i, item := range items {
+				if err := validateValue(schema.Items, item); err != nil {
+					return fmt.Errorf("item %d: %v", i, err)
+				}
+			}
+		}
+	case genai.TypeObject:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("expected object, got %T", value)
+		}
+		return validateArgs(schema, obj)
 	}
 	return nil
 }
 
-func ReadDesktopFile(filename string) ([]byte, error) {
+type fileWriteTool struct{}
+
+func (fileWriteTool) Name() string { return "file_write" }
+
+func (fileWriteTool) Description() string {
+	return "write a text file to user local file system with specified name and content."
+}
 
-	path, err := getDesktopdir()
+// Schema lists the extensions the user allows, so it is built on every call
+func (fileWriteTool) Schema() *genai.Schema {
+	return &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"fileName": {
+				Type:        genai.TypeString,
+				Description: "The name of the file to write to. Allowed extensions: " + strings.Join(allowedExtensions(), ", ") + ". Without extension .txt is added",
+			},
+			"content": {
+				Type:        genai.TypeString,
+				Description: "The text content to write to the file",
+			},
+			"mode": {
+				Type:        genai.TypeString,
+				Format:      "enum",
+				Enum:        []string{WriteModeCreate, WriteModeOverwrite, WriteModeAppend, WriteModeInsert},
+				Description: "create fails if the file exists, overwrite replaces it (default), append adds to the end, insert adds before the given line",
+			},
+			"line": {
+				Type:        genai.TypeInteger,
+				Description: "The line number (starting at 1) to insert the content before, only used by insert mode",
+			},
+		},
+		Required: []string{"fileName", "content"},
+	}
+}
+
+func (fileWriteTool) ReadOnly() bool { return false }
+
+func (fileWriteTool) Preview(args map[string]any) string {
+	mode, line := writeArgs(args)
+	write, err := planWrite(args["fileName"].(string), args["content"].(string), mode, line)
 	if err != nil {
-		return nil, errors.New("failed to get desktop directory")
+		return err.Error()
+	}
+	if write.existed {
+		return strings.ToUpper(mode[:1]) + mode[1:] + " " + write.path + ":\n\n" + lineDiff(string(write.old), write.content)
 	}
+	return "Create " + write.path + ":\n\n" + previewText(write.content)
+}
 
-	fullPath := filepath.Join(path, filename)
-	content, err := os.ReadFile(fullPath)
+func (fileWriteTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	mode, line := writeArgs(args)
+	path, err := WriteWorkspaceFile(args["fileName"].(string), args["content"].(string), mode, line)
+	var toolErr *ToolError
+	if errors.As(err, &toolErr) {
+		return nil, err
+	}
 	if err != nil {
-		return nil, errors.New("failed to read file")
+		return nil, errors.New("error writing file: " + err.Error())
 	}
+	return map[string]any{"result": "file written: " + path}, nil
+}
 
-	return content, nil
+// writeArgs returns the optional mode and line arguments of file_write
+func writeArgs(args map[string]any) (string, int) {
+	mode, _ := args["mode"].(string)
+	if mode == "" {
+		mode = WriteModeOverwrite
+	}
+	line, _ := args["line"].(float64)
+	return mode, int(line)
 }
 
-// OutDesktopFiles returns a list of files on the desktop
-func OutDesktopFiles() ([]string, error) {
-	path, err := getDesktopdir()
+type fileReadTool struct{}
+
+func (fileReadTool) Name() string { return "file_read" }
+
+func (fileReadTool) Description() string {
+	return "read a file from user local file system with specified name. Text is extracted from PDF, DOCX, XLSX and HTML files, long files are returned in pages."
+}
+
+func (fileReadTool) Schema() *genai.Schema { return fileReadSchema }
+
+func (fileReadTool) ReadOnly() bool { return true }
+
+func (fileReadTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	fileName := args["fileName"].(string)
+	path, err := resolvePath(fileName)
 	if err != nil {
 		return nil, err
 	}
-	files, err := os.ReadDir(path)
+	text, err := extractText(path)
+	if os.IsNotExist(err) {
+		return nil, &ToolError{Code: ErrCodeNotFound, Message: "file " + fileName + " does not exist"}
+	}
 	if err != nil {
 		return nil, err
 	}
-	var fileNames []string
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), ".") {
+
+	offset, _ := args["offset"].(float64)
+	limit := float64(defaultReadLines)
+	if l, ok := args["limit"].(float64); ok && l > 0 {
+		limit = l
+	}
+	page, next, total := textPage(text, int(offset), int(limit), maxReadChars)
+	result := map[string]any{"result": page, "totalLines": total}
+	if next > 0 {
+		result["nextOffset"] = next
+		result["note"] = fmt.Sprintf("the file continues, call file_read again with offset %d to read more", next)
+	}
+	return result, nil
+}
+
+type fileListTool struct{}
+
+func (fileListTool) Name() string { return "file_list" }
+
+func (fileListTool) Description() string {
+	return "list files and folders of the user's workspace folders with size and modification time"
+}
+
+func (fileListTool) Schema() *genai.Schema { return fileListSchema }
+
+func (fileListTool) ReadOnly() bool { return true }
+
+func (fileListTool) Invoke(ctx context.Context, args map[string]any) (map[string]any, error) {
+	dir, _ := args["dir"].(string)
+	glob, _ := args["glob"].(string)
+	depth := 1
+	if d, ok := args["depth"].(float64); ok {
+		depth = min(max(int(d), 1), maxSearchDepth)
+	}
+	entries, truncated, err := ListWorkspaceFiles(ctx, dir, depth, glob)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"result": entries, "truncated": truncated}, nil
+}
+
+// File write modes of WriteWorkspaceFile
+const (
+	WriteModeCreate    = "create"
+	WriteModeOverwrite = "overwrite"
+	WriteModeAppend    = "append"
+	WriteModeInsert    = "insert"
+)
+
+// DefaultAllowedExtensions is used when the allowed_extensions setting is not set
+const DefaultAllowedExtensions = ".txt,.md,.csv,.json,.go"
+
+// allowedExtensions returns the extensions file_write may create, lower case with dot
+func allowedExtensions() []string {
+	setting := DefaultAllowedExtensions
+	if db != nil {
+		setting = GetSetting(db, "allowed_extensions", DefaultAllowedExtensions)
+	}
+	var extensions []string
+	for _, ext := range strings.Split(setting, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
 			continue
 		}
-		if !file.IsDir() {
-			fileNames = append(fileNames, file.Name())
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions
+}
+
+// checkExtension returns a ToolError if files with ext may not be written
+func checkExtension(ext string) error {
+	if !slices.Contains(allowedExtensions(), strings.ToLower(ext)) {
+		return &ToolError{Code: ErrCodeNotPermitted, Message: fmt.Sprintf("writing %s files is not allowed, allowed extensions: %s", ext, strings.Join(allowedExtensions(), ", "))}
+	}
+	return nil
+}
+
+const (
+	defaultReadLines = 2000  // lines returned by file_read without a limit
+	maxReadChars     = 60000 // characters returned by one file_read call
+)
+
+// fileWrite is a planned WriteWorkspaceFile call
+type fileWrite struct {
+	path    string
+	existed bool
+	old     []byte
+	content string // the new content of the whole file
+}
+
+// planWrite resolves the file and computes its new content without writing it
+func planWrite(fileName string, content string, mode string, line int) (*fileWrite, error) {
+	// TODO if the file is txt, convert markdown to txt
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if ext == "" {
+		fileName, ext = fileName+".txt", ".txt"
+	}
+	if err := checkExtension(ext); err != nil {
+		return nil, err
+	}
+	path, err := resolvePath(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	write := &fileWrite{path: path}
+	write.old, err = os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	write.existed = err == nil
+
+	content = strings.ReplaceAll(content, "\\n", "\n")
+	switch mode {
+	case WriteModeCreate:
+		if write.existed {
+			return nil, &ToolError{Code: ErrCodeExists, Message: fmt.Sprintf("%s already exists, use another mode to change it", fileName)}
+		}
+		write.content = content
+	case WriteModeOverwrite:
+		write.content = content
+	case WriteModeAppend:
+		// the content starts a new line, not the end of the last one
+		if len(write.old) > 0 && !strings.HasSuffix(string(write.old), "\n") {
+			content = "\n" + content
+		}
+		write.content = string(write.old) + content
+	case WriteModeInsert:
+		lines := strings.SplitAfter(string(write.old), "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if line < 1 || line > len(lines)+1 {
+			return nil, &ToolError{Code: ErrCodeInvalidLine, Message: fmt.Sprintf("line must be between 1 and %d", len(lines)+1)}
+		}
+		if line <= len(lines) && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		if line == len(lines)+1 && line > 1 && !strings.HasSuffix(lines[line-2], "\n") {
+			content = "\n" + content
+		}
+		write.content = strings.Join(lines[:line-1], "") + content + strings.Join(lines[line-1:], "")
+	default:
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	return write, nil
+}
+
+// WriteWorkspaceFile writes a file to the workspace, see resolvePath and planWrite.
+// The previous state of the file is backed up first. Returns the path written.
+func WriteWorkspaceFile(fileName string, content string, mode string, line int) (string, error) {
+	write, err := planWrite(fileName, content, mode, line)
+	if err != nil {
+		return "", err
+	}
+	if err := backupFile(write.path, write.old, write.existed); err != nil {
+		return "", errors.Wrap(err, "backup failed")
+	}
+	// the path is inside a workspace root, so are the folders created for it
+	if err := os.MkdirAll(filepath.Dir(write.path), 0755); err != nil {
+		return "", errors.Wrap(err, "error creating folder")
+	}
+	return write.path, writeFileAtomic(write.path, []byte(write.content))
+}
+
+// ReadWorkspaceFile reads a file from the workspace, see resolvePath
+func ReadWorkspaceFile(filename string) ([]byte, error) {
+	fullPath, err := resolvePath(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return nil, &ToolError{Code: ErrCodeNotFound, Message: "file " + filename + " does not exist"}
+	}
+	if err != nil {
+		return nil, errors.New("failed to read file")
+	}
+
+	return content, nil
+}
+
+// ListWorkspaceFiles lists the entries below dir (all workspace roots when
+// empty) up to depth levels deep. With a glob only matching files are listed.
+func ListWorkspaceFiles(ctx context.Context, dir string, depth int, glob string) ([]any, bool, error) {
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return nil, false, fmt.Errorf("invalid glob: %v", err)
+	}
+	var entries []any
+	truncated := false
+	err := walkWorkspace(ctx, dir, depth, func(base string, path string, name string, d fs.DirEntry) error {
+		if glob != "" {
+			if ok, _ := filepath.Match(glob, d.Name()); !ok || d.IsDir() {
+				return nil
+			}
+		}
+		if len(entries) == maxListEntries {
+			truncated = true
+			return filepath.SkipAll
 		}
+		entries = append(entries, fileEntry(name, d))
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
 	}
-	return fileNames, nil
+	return entries, truncated, nil
 }
 
 // getDesktopdir returns the path to the desktop directory
@@ -155,35 +623,3 @@ func getDesktopdir() (string, error) {
 	}
 	return desktopDir, nil
 }
-
-func WriteMemory(title string, description string, value string) error {
-	var (
-		db  *gorm.DB
-		err error
-	)
-	db, err = GetDB()
-	if err != nil {
-		return err
-	}
-	err = InsertData(db, title, description, value)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func ReadMemory() (string, error) {
-	var (
-		db  *gorm.DB
-		err error
-	)
-	db, err = GetDB()
-	if err != nil {
-		return "", err
-	}
-	data, err := ReadDataAsJSON(db)
-	if err != nil {
-		return "", err
-	}
-	return data, nil
-}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestWorkspace makes a temporary folder the only workspace root
+func useTestWorkspace(t *testing.T) string {
+	t.Helper()
+	useTestDB(t)
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveWorkspaceRoots([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestPlanWrite(t *testing.T) {
+	root := useTestWorkspace(t)
+
+	tests := []struct {
+		name     string
+		old      *string // the file doesn't exist when nil
+		fileName string
+		content  string
+		mode     string
+		line     int
+		want     string
+		wantCode string
+	}{
+		{name: "create", fileName: "new.txt", content: "a\n", mode: WriteModeCreate, want: "a\n"},
+		{name: "create existing", old: ptr("a\n"), content: "b\n", mode: WriteModeCreate, wantCode: ErrCodeExists},
+		{name: "overwrite", old: ptr("a\n"), content: "b\n", mode: WriteModeOverwrite, want: "b\n"},
+		{name: "escaped newlines", fileName: "escaped.txt", content: `a\nb`, mode: WriteModeOverwrite, want: "a\nb"},
+		{name: "append", old: ptr("a\n"), content: "b\n", mode: WriteModeAppend, want: "a\nb\n"},
+		{name: "append without trailing newline", old: ptr("a"), content: "b", mode: WriteModeAppend, want: "a\nb"},
+		{name: "append to empty file", old: ptr(""), content: "b", mode: WriteModeAppend, want: "b"},
+		{name: "append to new file", fileName: "appended.txt", content: "b", mode: WriteModeAppend, want: "b"},
+		{name: "insert at line 0", old: ptr("a\nb\n"), content: "x", mode: WriteModeInsert, line: 0, wantCode: ErrCodeInvalidLine},
+		{name: "insert at line 1", old: ptr("a\nb\n"), content: "x", mode: WriteModeInsert, line: 1, want: "x\na\nb\n"},
+		{name: "insert in the middle", old: ptr("a\nb\n"), content: "x\n", mode: WriteModeInsert, line: 2, want: "a\nx\nb\n"},
+		{name: "insert after the last line", old: ptr("a\nb\n"), content: "x", mode: WriteModeInsert, line: 3, want: "a\nb\nx"},
+		{name: "insert after the last line without trailing newline", old: ptr("a\nb"), content: "x", mode: WriteModeInsert, line: 3, want: "a\nb\nx"},
+		{name: "insert past the end", old: ptr("a\nb\n"), content: "x", mode: WriteModeInsert, line: 4, wantCode: ErrCodeInvalidLine},
+		{name: "insert into new file", fileName: "inserted.txt", content: "x", mode: WriteModeInsert, line: 1, want: "x"},
+		{name: "extension not allowed", fileName: "run.exe", content: "x", mode: WriteModeCreate, wantCode: ErrCodeNotPermitted},
+		{name: "outside the workspace", fileName: filepath.Join("..", "escape.txt"), content: "x", mode: WriteModeCreate, wantCode: ErrCodeOutsideRoots},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := tt.fileName
+			if tt.old != nil {
+				fileName = filepath.Join("existing", fmt.Sprintf("%d.txt", i))
+				path := filepath.Join(root, fileName)
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(*tt.old), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write, err := planWrite(fileName, tt.content, tt.mode, tt.line)
+			if tt.wantCode != "" {
+				var toolErr *ToolError
+				if !errors.As(err, &toolErr) || toolErr.Code != tt.wantCode {
+					t.Fatalf("err = %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if write.content != tt.want {
+				t.Errorf("content = %q, want %q", write.content, tt.want)
+			}
+			if write.existed != (tt.old != nil) {
+				t.Errorf("existed = %v", write.existed)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestWriteWorkspaceFileCreatesFolders(t *testing.T) {
+	root := useTestWorkspace(t)
+
+	path, err := WriteWorkspaceFile(filepath.Join("notes", "2024", "todo.txt"), "buy milk", WriteModeCreate, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "notes", "2024", "todo.txt"); path != want {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+	data, err := ReadWorkspaceFile(filepath.Join("notes", "2024", "todo.txt"))
+	if err != nil || string(data) != "buy milk" {
+		t.Errorf("read back %q, %v", data, err)
+	}
+
+	// a file in the way of the folder
+	if _, err := WriteWorkspaceFile(filepath.Join("notes", "2024", "todo.txt", "more.txt"), "x", WriteModeCreate, 0); err == nil {
+		t.Error("expected an error writing below a file")
+	}
+}
+
+func TestWriteWorkspaceFileReplacesAtomically(t *testing.T) {
+	root := useTestWorkspace(t)
+	path := filepath.Join(root, "script.txt")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := WriteWorkspaceFile("script.txt", "new", WriteModeOverwrite, 0); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want the mode of the replaced file", info.Mode().Perm())
+	}
+	// no temporary file is left behind
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("folder has %d entries, want only script.txt", len(entries))
+	}
+}
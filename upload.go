@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	uploadThreshold   = 4 << 20   // larger attachments are uploaded instead of sent inline
+	uploadReuseMargin = time.Hour // uploads expiring sooner are uploaded again
+	uploadPollDelay   = 2 * time.Second
+)
+
+// FileUploader is implemented by providers which can store attachments on
+// the server, messages then reference them by URI instead of carrying the data
+type FileUploader interface {
+	UploadFile(ctx context.Context, path string, mimeType string) (genai.FileData, error)
+	// UploadAccount identifies the API key the uploads belong to, other keys
+	// can't use them
+	UploadAccount() string
+}
+
+func (p *GeminiProvider) UploadAccount() string {
+	return p.account
+}
+
+// uploadAccount returns the account of the provider's uploads, empty if it
+// can't upload files
+func uploadAccount(provider Provider) string {
+	if uploader, ok := provider.(FileUploader); ok {
+		return uploader.UploadAccount()
+	}
+	return ""
+}
+
+// availableUpload returns the uploaded file behind uri if account can use
+// it, or else an upload of the same content made with account. ok is false
+// if there is no such upload which is still on the server.
+func availableUpload(uri string, account string) (file genai.FileData, ok bool) {
+	if account == "" {
+		return genai.FileData{}, false
+	}
+	uploaded, err := GetUploadedFileByURI(db, uri)
+	if err != nil || uploaded == nil {
+		return genai.FileData{}, false
+	}
+	validUntil := time.Now().Add(uploadReuseMargin)
+	if uploaded.Account != account || !uploaded.ExpiresAt.After(validUntil) {
+		uploaded, err = FindUploadedFile(db, uploaded.Hash, account, validUntil)
+		if err != nil || uploaded == nil {
+			return genai.FileData{}, false
+		}
+	}
+	return genai.FileData{MIMEType: uploaded.MIMEType, URI: uploaded.URI}, true
+}
+
+// useUploads returns history with its uploaded files replaced by those
+// account can use, files it can't use become a note
+func useUploads(history []*genai.Content, account string) []*genai.Content {
+	result := make([]*genai.Content, len(history))
+	for i, content := range history {
+		result[i] = content
+		for j, part := range content.Parts {
+			file, isFile := part.(genai.FileData)
+			if !isFile {
+				continue
+			}
+			if result[i] == content {
+				result[i] = &genai.Content{Role: content.Role, Parts: append([]genai.Part{}, content.Parts...)}
+			}
+			if available, ok := availableUpload(file.URI, account); ok {
+				result[i].Parts[j] = available
+			} else {
+				result[i].Parts[j] = unavailableAttachment(&Attachment{MIMEType: file.MIMEType})
+			}
+		}
+	}
+	return result
+}
+
+// UploadFile uploads a file with the File API. A file uploaded before with
+// the same content is reused until it expires (the server keeps files for 48 hours).
+func (p *GeminiProvider) UploadFile(ctx context.Context, path string, mimeType string) (genai.FileData, error) {
+	hash, err := fileHash(path)
+	if err != nil {
+		return genai.FileData{}, err
+	}
+	uploaded, err := FindUploadedFile(db, hash, p.account, time.Now().Add(uploadReuseMargin))
+	if err != nil {
+		log.Println("Error looking up uploaded file:", err)
+	}
+	if uploaded != nil {
+		log.Println("Reusing uploaded file:", uploaded.Name)
+		return genai.FileData{MIMEType: uploaded.MIMEType, URI: uploaded.URI}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return genai.FileData{}, err
+	}
+	defer f.Close()
+	log.Println("Uploading file:", path)
+	file, err := p.client.UploadFile(ctx, "", f, &genai.UploadFileOptions{DisplayName: filepath.Base(path), MIMEType: mimeType})
+	if err != nil {
+		return genai.FileData{}, fmt.Errorf("upload failed: %v", err)
+	}
+
+	// videos and audio are processed before they can be used
+	for file.State == genai.FileStateProcessing {
+		select {
+		case <-ctx.Done():
+			return genai.FileData{}, ctx.Err()
+		case <-time.After(uploadPollDelay):
+		}
+		file, err = p.client.GetFile(ctx, file.Name)
+		if err != nil {
+			return genai.FileData{}, err
+		}
+	}
+	if file.State == genai.FileStateFailed {
+		return genai.FileData{}, fmt.Errorf("the server could not process %s", filepath.Base(path))
+	}
+
+	if err := DeleteExpiredUploads(db); err != nil {
+		log.Println("Error deleting expired uploads:", err)
+	}
+	err = SaveUploadedFile(db, &UploadedFile{
+		Hash:      hash,
+		Account:   p.account,
+		Name:      file.Name,
+		URI:       file.URI,
+		MIMEType:  file.MIMEType,
+		Size:      file.SizeBytes,
+		ExpiresAt: file.ExpirationTime,
+	})
+	if err != nil {
+		log.Println("Error saving uploaded file:", err)
+	}
+	return genai.FileData{MIMEType: file.MIMEType, URI: file.URI}, nil
+}
+
+// fileHash returns the hex sha256 of a file
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// accountID returns a short hash identifying an API key without storing it
+func accountID(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:8])
+}
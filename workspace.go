@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Tool error codes, see ToolError
+const (
+	ErrCodeInvalidPath  = "invalid_path"
+	ErrCodeOutsideRoots = "path_outside_workspace"
+	ErrCodeNotFound     = "not_found"
+	ErrCodeNoWorkspace  = "no_workspace"
+	ErrCodeNotPermitted = "not_permitted"
+	ErrCodeExists       = "already_exists"
+	ErrCodeInvalidLine  = "invalid_line"
+)
+
+// workspaceRoots returns the folders the file tools may access, the first one
+// is where new files are created. Defaults to the Desktop.
+func workspaceRoots() []string {
+	var roots []string
+	if db != nil {
+		if err := json.Unmarshal([]byte(GetSetting(db, "workspace_roots", "[]")), &roots); err != nil {
+			log.Println("Error reading workspace roots:", err)
+		}
+	}
+	if len(roots) == 0 {
+		desktop, err := getDesktopdir()
+		if err != nil {
+			return nil
+		}
+		roots = []string{desktop}
+	}
+	return roots
+}
+
+func saveWorkspaceRoots(roots []string) error {
+	data, err := json.Marshal(roots)
+	if err != nil {
+		return err
+	}
+	return SaveSetting(db, "workspace_roots", string(data))
+}
+
+// resolvedRoots returns the workspace roots with symlinks resolved, roots
+// which don't exist are skipped
+func resolvedRoots() []string {
+	var roots []string
+	for _, root := range workspaceRoots() {
+		real, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			log.Println("Skipping workspace root:", err)
+			continue
+		}
+		roots = append(roots, real)
+	}
+	return roots
+}
+
+// resolvePath returns the real path of a file named by the model. Relative
+// names are looked up in every root and new files go to the first one,
+// absolute names must point into a root. Symlinks are followed before the
+// check so a link can't be used to escape the roots.
+func resolvePath(name string) (string, error) {
+	if strings.TrimSpace(name) == "" || strings.ContainsRune(name, 0) {
+		return "", &ToolError{Code: ErrCodeInvalidPath, Message: fmt.Sprintf("invalid file name %q", name)}
+	}
+	roots := resolvedRoots()
+	if len(roots) == 0 {
+		return "", &ToolError{Code: ErrCodeNoWorkspace, Message: "no workspace folder is configured"}
+	}
+
+	var candidates []string
+	if filepath.IsAbs(name) {
+		candidates = []string{filepath.Clean(name)}
+	} else {
+		for _, root := range roots {
+			candidates = append(candidates, filepath.Join(root, name))
+		}
+	}
+
+	path := candidates[0]
+	for _, candidate := range candidates {
+		if _, err := os.Lstat(candidate); err == nil {
+			path = candidate
+			break
+		}
+	}
+
+	real := realPath(path)
+	for _, root := range roots {
+		if isWithin(real, root) {
+			return real, nil
+		}
+	}
+	return "", &ToolError{Code: ErrCodeOutsideRoots, Message: fmt.Sprintf("%s is outside the folders the user allowed", name)}
+}
+
+// realPath resolves the symlinks of the longest existing prefix of path
+func realPath(path string) string {
+	rest := ""
+	for p := path; ; {
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(real, rest)
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return path
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// isWithin reports whether path is root or inside it
+func isWithin(path string, root string) bool {
+	if runtime.GOOS == "windows" {
+		path, root = strings.ToLower(path), strings.ToLower(root)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
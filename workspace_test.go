@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		path string
+		root string
+		want bool
+	}{
+		{"/home/a/ws", "/home/a/ws", true},
+		{"/home/a/ws/file.txt", "/home/a/ws", true},
+		{"/home/a/ws/sub/file.txt", "/home/a/ws", true},
+		{"/home/a/ws/..file", "/home/a/ws", true},
+		{"/home/a/ws2", "/home/a/ws", false},
+		{"/home/a/ws2/file.txt", "/home/a/ws", false},
+		{"/home/a", "/home/a/ws", false},
+		{"/home/a/ws/../ws2/file.txt", "/home/a/ws", false},
+		{"/etc/passwd", "/home/a/ws", false},
+	}
+	for _, tt := range tests {
+		path, root := filepath.FromSlash(tt.path), filepath.FromSlash(tt.root)
+		if got := isWithin(path, root); got != tt.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", path, root, got, tt.want)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	useTestDB(t)
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := filepath.Join(base, "ws")
+	ws2 := filepath.Join(base, "ws2") // shares the prefix of ws but isn't a root
+	extra := filepath.Join(base, "extra")
+	outside := filepath.Join(base, "outside")
+	for _, file := range []string{
+		filepath.Join(ws, "a.txt"),
+		filepath.Join(ws, "sub", "b.txt"),
+		filepath.Join(ws2, "x.txt"),
+		filepath.Join(extra, "c.txt"),
+		filepath.Join(outside, "secret.txt"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlinks := os.Symlink(outside, filepath.Join(ws, "link")) == nil &&
+		os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(ws, "filelink")) == nil
+	if err := saveWorkspaceRoots([]string{ws, extra}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		want     string // resolved path, empty if an error is expected
+		wantCode string
+		symlink  bool
+	}{
+		{name: "a.txt", want: filepath.Join(ws, "a.txt")},
+		{name: filepath.Join("sub", "b.txt"), want: filepath.Join(ws, "sub", "b.txt")},
+		{name: filepath.Join("sub", "..", "a.txt"), want: filepath.Join(ws, "a.txt")},
+		{name: filepath.Join(ws, "a.txt"), want: filepath.Join(ws, "a.txt")},
+		{name: "c.txt", want: filepath.Join(extra, "c.txt")},
+		// new files go to the first root
+		{name: "new.txt", want: filepath.Join(ws, "new.txt")},
+		{name: filepath.Join("newdir", "new.txt"), want: filepath.Join(ws, "newdir", "new.txt")},
+		{name: filepath.Join(extra, "new.txt"), want: filepath.Join(extra, "new.txt")},
+
+		{name: filepath.Join("..", "outside", "secret.txt"), wantCode: ErrCodeOutsideRoots},
+		{name: filepath.Join("sub", "..", "..", "outside", "secret.txt"), wantCode: ErrCodeOutsideRoots},
+		{name: filepath.Join("..", "outside", "new.txt"), wantCode: ErrCodeOutsideRoots},
+		{name: filepath.Join(outside, "secret.txt"), wantCode: ErrCodeOutsideRoots},
+		{name: filepath.Join(ws2, "x.txt"), wantCode: ErrCodeOutsideRoots},
+		{name: filepath.Join("..", "ws2", "x.txt"), wantCode: ErrCodeOutsideRoots},
+		{name: ws2, wantCode: ErrCodeOutsideRoots},
+		{name: filepath.Join("link", "secret.txt"), wantCode: ErrCodeOutsideRoots, symlink: true},
+		{name: filepath.Join("link", "new.txt"), wantCode: ErrCodeOutsideRoots, symlink: true},
+		{name: "filelink", wantCode: ErrCodeOutsideRoots, symlink: true},
+		{name: "", wantCode: ErrCodeInvalidPath},
+		{name: "a\x00.txt", wantCode: ErrCodeInvalidPath},
+	}
+	for _, tt := range tests {
+		if tt.symlink && !symlinks {
+			t.Logf("skipping %q, symlinks can't be created", tt.name)
+			continue
+		}
+		got, err := resolvePath(tt.name)
+		if tt.wantCode == "" {
+			if err != nil || got != tt.want {
+				t.Errorf("resolvePath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+			}
+			continue
+		}
+		var toolErr *ToolError
+		if !errors.As(err, &toolErr) || toolErr.Code != tt.wantCode {
+			t.Errorf("resolvePath(%q) = %q, %v, want error %s", tt.name, got, err, tt.wantCode)
+		}
+	}
+}
+
+func TestResolvePathWithoutRoots(t *testing.T) {
+	useTestDB(t)
+	if err := saveWorkspaceRoots([]string{filepath.Join(t.TempDir(), "missing")}); err != nil {
+		t.Fatal(err)
+	}
+	var toolErr *ToolError
+	if _, err := resolvePath("a.txt"); !errors.As(err, &toolErr) || toolErr.Code != ErrCodeNoWorkspace {
+		t.Errorf("resolvePath without existing roots = %v, want %s", err, ErrCodeNoWorkspace)
+	}
+}